@@ -28,9 +28,15 @@ func main() {
 		panic(err)
 	}
 	ctx := context.Background()
-	go r.Run(ctx)
+	go func() {
+		if err := r.Run(ctx); err != nil {
+			panic(err)
+		}
+	}()
 
-	// waiting runtime running
+	if err = r.WaitForReady(ctx); err != nil {
+		panic(err)
+	}
 	connectors, err := r.Lister().List(labels.Everything())
 	if err != nil {
 		fmt.Println("failed to list connectors")
@@ -44,14 +44,61 @@ type ConnectorSpec struct {
 	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
 }
 
+// ConnectorPhase is a label for the condition of a connector at the current time.
+type ConnectorPhase string
+
+const (
+	// ConnectorPending means the connector has been accepted but is not running yet.
+	ConnectorPending ConnectorPhase = "Pending"
+	// ConnectorRunning means the connector has been started by the runtime.
+	ConnectorRunning ConnectorPhase = "Running"
+	// ConnectorFailed means the runtime failed to start or update the connector.
+	ConnectorFailed ConnectorPhase = "Failed"
+	// ConnectorDeleting means the connector is being stopped by the runtime.
+	ConnectorDeleting ConnectorPhase = "Deleting"
+)
+
+// These are valid condition types of a connector.
+const (
+	// ConnectorReady means the connector is running and able to process events.
+	ConnectorReady = "Ready"
+	// ConnectorConfigValid means the config of the connector was accepted by the runtime.
+	ConnectorConfigValid = "ConfigValid"
+	// ConnectorDegraded means the connector is running but not working as expected.
+	ConnectorDegraded = "Degraded"
+)
+
 // ConnectorStatus defines the observed state of Connector
 type ConnectorStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// Phase is a simple, high-level summary of where the connector is in its lifecycle.
+	// +optional
+	Phase ConnectorPhase `json:"phase,omitempty"`
+	// Conditions represent the latest available observations of the connector's state.
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// ObservedGeneration is the most recent generation observed by the runtime.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastError is the message of the last error returned while handling the connector.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+	// LastTransitionTime is the last time the phase transitioned from one to another.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Kind",type=string,JSONPath=`.spec.kind`
+//+kubebuilder:printcolumn:name="Type",type=string,JSONPath=`.spec.type`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // +genclient
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
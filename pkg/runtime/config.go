@@ -34,48 +34,99 @@ type Config struct {
 	VanusFactoryClient clientset.Interface
 }
 
+const (
+	defaultQPS   = 1000
+	defaultBurst = 2000
+)
+
+// clientOptions controls how the clients of runtime are built.
+type clientOptions struct {
+	restConfig     *rest.Config
+	vanusClient    clientset.Interface
+	kubeClient     kubernetes.Interface
+	kubeconfigPath string
+	kubeContext    string
+	qps            float32
+	burst          int
+}
+
 // ParseFlags parses cmd args then init kubeclient and conf
 // TODO: validate configuration
 func NewConfig() (*Config, error) {
-	config := &Config{}
-	if err := config.initKubeFactoryClient(); err != nil {
+	return newConfig(clientOptions{})
+}
+
+func newConfig(opts clientOptions) (*Config, error) {
+	config := &Config{
+		KubeConfigFile:     opts.kubeconfigPath,
+		VanusFactoryClient: opts.vanusClient,
+		KubeFactoryClient:  opts.kubeClient,
+	}
+	if config.VanusFactoryClient != nil && config.KubeFactoryClient != nil && opts.restConfig == nil {
+		// all the clients are injected, nothing to build
+		return config, nil
+	}
+	if err := config.initKubeFactoryClient(opts); err != nil {
 		return nil, err
 	}
 	return config, nil
 }
 
-func (config *Config) initKubeFactoryClient() error {
+func (config *Config) initKubeFactoryClient(opts clientOptions) error {
 	var cfg *rest.Config
 	var err error
-	config.KubeConfigFile = GetKubeConfigFromEnv()
-	cfg, err = GetInClusterOrKubeConfig(config.KubeConfigFile)
-	if err != nil {
-		klog.Errorf("failed to build kubeconfig %v", err)
-		return err
+	if opts.restConfig != nil {
+		cfg = rest.CopyConfig(opts.restConfig)
+	} else {
+		cfg, err = loadRestConfig(opts.kubeconfigPath, opts.kubeContext)
+		if err != nil {
+			klog.Errorf("failed to build kubeconfig %v", err)
+			return err
+		}
+		cfg.QPS = defaultQPS
+		cfg.Burst = defaultBurst
+	}
+	if opts.qps > 0 {
+		cfg.QPS = opts.qps
+	}
+	if opts.burst > 0 {
+		cfg.Burst = opts.burst
 	}
-	cfg.QPS = 1000
-	cfg.Burst = 2000
 
 	config.KubeRestConfig = cfg
 
-	VanusClient, err := clientset.NewForConfig(cfg)
-	if err != nil {
-		klog.Errorf("init vanus client failed %v", err)
-		return err
+	if config.VanusFactoryClient == nil {
+		VanusClient, err := clientset.NewForConfig(cfg)
+		if err != nil {
+			klog.Errorf("init vanus client failed %v", err)
+			return err
+		}
+		config.VanusFactoryClient = VanusClient
 	}
-	config.VanusFactoryClient = VanusClient
-
-	cfg.ContentType = "application/vnd.kubernetes.protobuf"
-	cfg.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
-	kubeClient, err := kubernetes.NewForConfig(cfg)
-	if err != nil {
-		klog.Errorf("init kubernetes client failed %v", err)
-		return err
+
+	if config.KubeFactoryClient == nil {
+		kubeCfg := rest.CopyConfig(cfg)
+		kubeCfg.ContentType = "application/vnd.kubernetes.protobuf"
+		kubeCfg.AcceptContentTypes = "application/vnd.kubernetes.protobuf,application/json"
+		kubeClient, err := kubernetes.NewForConfig(kubeCfg)
+		if err != nil {
+			klog.Errorf("init kubernetes client failed %v", err)
+			return err
+		}
+		config.KubeFactoryClient = kubeClient
 	}
-	config.KubeFactoryClient = kubeClient
 	return nil
 }
 
+// loadRestConfig loads the rest config following the standard kubeconfig resolution, i.e.
+// the explicit path, $KUBECONFIG, $HOME/.kube/config, then the in-cluster config.
+func loadRestConfig(kubeconfigPath, kubeContext string) (*rest.Config, error) {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfigPath
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubeContext}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+}
+
 func GetKubeConfigFromEnv() string {
 	home := os.Getenv("HOME")
 	if home != "" {
@@ -0,0 +1,100 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/client/clientset/versioned/fake"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+)
+
+// withoutKubeconfig makes resolving a kubeconfig fail.
+func withoutKubeconfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KUBECONFIG", filepath.Join(dir, "missing"))
+	t.Setenv("HOME", dir)
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+}
+
+func TestNewWithVanusClient(t *testing.T) {
+	withoutKubeconfig(t)
+	client := fake.NewSimpleClientset()
+	added := make(chan string, 1)
+	r, err := runtime.New(
+		runtime.WithVanusClient(client),
+		runtime.WithHandler(runtime.ConnectorHandlerFuncs{
+			AddFunc: func(_ context.Context, connector *vanusv1alpha1.Connector) error {
+				added <- connector.Name
+				return nil
+			},
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create runtime: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = r.Run(ctx)
+	}()
+	readyCtx, readyCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer readyCancel()
+	if err = r.WaitForReady(readyCtx); err != nil {
+		t.Fatalf("runtime is not ready: %v", err)
+	}
+
+	_, err = client.VanusV1alpha1().Connectors().Create(ctx, &vanusv1alpha1.Connector{
+		ObjectMeta: metav1.ObjectMeta{Name: "a"},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create connector: %v", err)
+	}
+	select {
+	case name := <-added:
+		if name != "a" {
+			t.Fatalf("unexpected connector %s", name)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for connector to be added")
+	}
+}
+
+func TestNewRequiresKubeClient(t *testing.T) {
+	withoutKubeconfig(t)
+	_, err := runtime.New(
+		runtime.WithVanusClient(fake.NewSimpleClientset()),
+		runtime.WithConnectorLeases("default"),
+	)
+	if err == nil {
+		t.Fatal("expected an error building the Kubernetes client without kubeconfig")
+	}
+
+	_, err = runtime.New(
+		runtime.WithVanusClient(fake.NewSimpleClientset()),
+		runtime.WithKubeClient(kubefake.NewSimpleClientset()),
+		runtime.WithConnectorLeases("default"),
+	)
+	if err != nil {
+		t.Fatalf("failed to create runtime: %v", err)
+	}
+}
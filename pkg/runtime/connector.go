@@ -15,9 +15,14 @@
 package runtime
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 
+	"k8s.io/apimachinery/pkg/api/equality"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/tools/cache"
 	log "k8s.io/klog/v2"
@@ -33,72 +38,160 @@ func (r *runtime) enqueueAddConnector(obj interface{}) {
 		return
 	}
 	log.Infof("enqueue add connector %s", key)
-	r.addConnectorQueue.Add(key)
+	r.connectorQueue.Add(key)
 }
 
 func (r *runtime) enqueueUpdateConnector(old, new interface{}) {
-	oldKey, err := cache.MetaNamespaceKeyFunc(new)
-	if err != nil {
-		utilruntime.HandleError(err)
+	oldConnector, ok1 := old.(*vanusv1alpha1.Connector)
+	newConnector, ok2 := new.(*vanusv1alpha1.Connector)
+	if ok1 && ok2 && writtenByRuntime(oldConnector, newConnector) {
+		// nothing to do for handler
 		return
 	}
-	newKey, err := cache.MetaNamespaceKeyFunc(new)
+	key, err := cache.MetaNamespaceKeyFunc(new)
 	if err != nil {
 		utilruntime.HandleError(err)
 		return
 	}
-
-	log.Infof("old connector: %s\n", oldKey)
-	log.Infof("new connector: %s\n", newKey)
-	r.updateConnectorQueue.Add(newKey)
+	log.Infof("enqueue update connector %s", key)
+	r.connectorQueue.Add(key)
 }
 
 func (r *runtime) enqueueDeleteConnector(obj interface{}) {
+	// the informer delivers a tombstone if it missed the delete notification, its key is used
+	// whatever its final state is
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		log.Infof("connector %s deleted with final state unknown", tombstone.Key)
+	}
 	var key string
 	var err error
-	if key, err = cache.MetaNamespaceKeyFunc(obj); err != nil {
+	if key, err = cache.DeletionHandlingMetaNamespaceKeyFunc(obj); err != nil {
 		utilruntime.HandleError(err)
 		return
 	}
-	log.Infof("enqueue delete connector %s\n", key)
-	r.deleteConnectorQueue.Add(obj)
+	log.Infof("enqueue delete connector %s", key)
+	r.connectorQueue.Add(key)
+}
+
+// enqueueOrphanConnectors asks the handler for the connectors it's running and enqueues those
+// that no longer exist, so the deletions missed while the runtime was not watching are handled.
+func (r *runtime) enqueueOrphanConnectors(ctx context.Context) error {
+	var activeLister ActiveConnectorLister
+	var ok bool
+	if r.reconciler != nil {
+		activeLister, ok = r.reconciler.(ActiveConnectorLister)
+	} else {
+		activeLister, ok = r.handler.(ActiveConnectorLister)
+	}
+	if !ok {
+		return nil
+	}
+	connectorIDs, err := activeLister.ActiveConnectors(ctx)
+	if err != nil {
+		return err
+	}
+	for _, connectorID := range connectorIDs {
+		if _, err = r.lister().Get(connectorID); err == nil {
+			continue
+		} else if !k8serrors.IsNotFound(err) {
+			return err
+		}
+		if r.getApplied(connectorID) == nil {
+			// only the name is known, which is enough for the handler to stop it
+			r.setApplied(connectorID, &vanusv1alpha1.Connector{ObjectMeta: metav1.ObjectMeta{Name: connectorID}})
+		}
+		log.Infof("enqueue orphan connector %s", connectorID)
+		r.connectorQueue.Add(connectorID)
+	}
+	return nil
 }
 
-func (r *runtime) runAddConnectorWorker() {
-	for r.processNextAddConnectorWorkItem() {
+// enqueueAllConnectors enqueues all the connectors selected by the runtime.
+func (r *runtime) enqueueAllConnectors() error {
+	connectors, err := r.lister().List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, connector := range connectors {
+		r.connectorQueue.Add(connector.Name)
 	}
+	return nil
 }
 
-func (r *runtime) runUpdateConnectorWorker() {
-	for r.processNextUpdateConnectorWorkItem() {
+// enqueueAppliedConnectors enqueues all the connectors applied to the handler.
+func (r *runtime) enqueueAppliedConnectors() {
+	r.appliedLock.RLock()
+	defer r.appliedLock.RUnlock()
+	for key := range r.applied {
+		r.connectorQueue.Add(key)
 	}
 }
 
-func (r *runtime) runDeleteConnectorWorker() {
-	for r.processNextDeleteConnectorWorkItem() {
+func (r *runtime) runConnectorWorker(ctx, handlerCtx context.Context) {
+	r.activeWorkers.Add(1)
+	defer r.activeWorkers.Add(-1)
+	for r.processNextConnectorWorkItem(ctx, handlerCtx) {
 	}
 }
 
-func (r *runtime) processNextAddConnectorWorkItem() bool {
-	obj, shutdown := r.addConnectorQueue.Get()
+// processNextConnectorWorkItem syncs the next connector key in the queue, the queue never
+// hands out the same key to two workers at the same time, so all the handler invocations of
+// a connector are strictly ordered. No key is taken once ctx is done, the handler is invoked
+// with handlerCtx.
+func (r *runtime) processNextConnectorWorkItem(ctx, handlerCtx context.Context) bool {
+	obj, shutdown := r.connectorQueue.Get()
 	if shutdown {
 		return false
 	}
+	r.syncing.Add(1)
+	defer r.syncing.Add(-1)
+
+	// hold the sync lock while invoking the handler, so the connectors can be released
+	// after all the in-flight invocations returned
+	r.syncLock.RLock()
+	defer r.syncLock.RUnlock()
+	if ctx.Err() != nil {
+		// the worker is stopping, leave the key to the next one
+		r.connectorQueue.Add(obj)
+		r.connectorQueue.Done(obj)
+		return false
+	}
+	ctx = handlerCtx
 
 	err := func(obj interface{}) error {
-		defer r.addConnectorQueue.Done(obj)
+		defer r.connectorQueue.Done(obj)
 		var key string
 		var ok bool
 		if key, ok = obj.(string); !ok {
-			r.addConnectorQueue.Forget(obj)
+			r.connectorQueue.Forget(obj)
 			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
 			return nil
 		}
-		if err := r.handleAddConnector(key); err != nil {
-			r.addConnectorQueue.AddRateLimited(key)
+		result, err := r.syncConnector(ctx, key)
+		if err != nil {
+			attempts := r.connectorQueue.NumRequeues(key) + 1
+			switch {
+			case IsPermanentError(err):
+				r.connectorQueue.Forget(obj)
+				r.recordGiveUp(ctx, key, reasonPermanentError, err)
+				return fmt.Errorf("error syncing '%s': %s, permanent error, giving up", key, err.Error())
+			case r.retryPolicy.MaxAttempts > 0 && attempts >= r.retryPolicy.MaxAttempts:
+				r.connectorQueue.Forget(obj)
+				r.recordGiveUp(ctx, key, reasonRetriesExhausted, err)
+				return fmt.Errorf("error syncing '%s': %s, giving up after %d attempts", key, err.Error(), attempts)
+			}
+			r.connectorQueue.AddRateLimited(key)
 			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
 		}
-		r.addConnectorQueue.Forget(obj)
+		switch {
+		case result.RequeueAfter > 0:
+			r.connectorQueue.Forget(obj)
+			r.connectorQueue.AddAfter(key, result.RequeueAfter)
+		case result.Requeue:
+			r.connectorQueue.AddRateLimited(key)
+		default:
+			r.connectorQueue.Forget(obj)
+		}
 		return nil
 	}(obj)
 
@@ -109,108 +202,266 @@ func (r *runtime) processNextAddConnectorWorkItem() bool {
 	return true
 }
 
-func (r *runtime) processNextUpdateConnectorWorkItem() bool {
-	obj, shutdown := r.updateConnectorQueue.Get()
-	if shutdown {
-		return false
+// syncConnector compares the cached connector with the one last applied to the handler and
+// decides whether the connector should be added, updated or deleted.
+func (r *runtime) syncConnector(ctx context.Context, key string) (Result, error) {
+	cachedConnector, err := r.lister().Get(key)
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return Result{}, err
+		}
+		cachedConnector = nil
 	}
-
-	err := func(obj interface{}) error {
-		defer r.updateConnectorQueue.Done(obj)
-		var key string
-		var ok bool
-		if key, ok = obj.(string); !ok {
-			r.updateConnectorQueue.Forget(obj)
-			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
-			return nil
+	exists := cachedConnector != nil
+	var ownResult Result
+	if cachedConnector != nil {
+		var owned bool
+		if owned, ownResult, err = r.ownsConnector(ctx, key); err != nil {
+			return Result{}, err
 		}
-		if err := r.handleUpdateConnector(key); err != nil {
-			r.updateConnectorQueue.AddRateLimited(key)
-			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
+		if !owned {
+			// owned by another runtime, release it if it was applied
+			cachedConnector = nil
 		}
-		r.updateConnectorQueue.Forget(obj)
-		return nil
-	}(obj)
+	}
 
-	if err != nil {
-		utilruntime.HandleError(err)
-		return true
+	var result Result
+	if r.reconciler != nil {
+		result, err = r.reconcileConnector(ctx, key, cachedConnector)
+	} else {
+		err = r.handleConnector(ctx, key, cachedConnector)
 	}
-	return true
+	if err == nil && r.leases != nil && r.getApplied(key) == nil {
+		// the lease of a connector which no longer exists is deleted, not only released
+		if exists {
+			r.leases.release(ctx, key)
+		} else {
+			r.leases.remove(ctx, key)
+		}
+	}
+	if result.RequeueAfter == 0 && !result.Requeue {
+		result = ownResult
+	}
+	return result, err
 }
 
-func (r *runtime) processNextDeleteConnectorWorkItem() bool {
-	obj, shutdown := r.deleteConnectorQueue.Get()
-	if shutdown {
-		return false
+// ownsConnector returns true if the connector should be run by this runtime.
+func (r *runtime) ownsConnector(ctx context.Context, key string) (bool, Result, error) {
+	if r.sharder != nil && !r.sharder.owns(key) {
+		return false, Result{}, nil
+	}
+	if r.leases == nil {
+		return true, Result{}, nil
+	}
+	if r.leases.lost(key) {
+		// stop the connector before another runtime may take it over, and try to acquire
+		// the lease again later
+		log.Warningf("lease of connector %s lost", key)
+		return false, Result{RequeueAfter: r.leases.period}, nil
+	}
+	acquired, err := r.leases.acquire(ctx, key)
+	if err != nil {
+		return false, Result{}, err
+	}
+	if !acquired {
+		return false, Result{RequeueAfter: r.leases.duration}, nil
 	}
+	return true, Result{}, nil
+}
 
-	err := func(obj interface{}) error {
-		defer r.deleteConnectorQueue.Done(obj)
-		var connector *vanusv1alpha1.Connector
-		var ok bool
-		if connector, ok = obj.(*vanusv1alpha1.Connector); !ok {
-			r.deleteConnectorQueue.Forget(obj)
-			utilruntime.HandleError(fmt.Errorf("expected connector in workqueue but got %#v", obj))
+func (r *runtime) handleConnector(ctx context.Context, key string, cachedConnector *vanusv1alpha1.Connector) error {
+	applied := r.getApplied(key)
+	switch {
+	case cachedConnector == nil:
+		if applied == nil {
 			return nil
 		}
-		if err := r.handleDeleteConnector(connector); err != nil {
-			r.deleteConnectorQueue.AddRateLimited(obj)
-			return fmt.Errorf("error syncing '%s': %s, requeuing", connector.Name, err.Error())
+		if err := r.handleDeleteConnector(ctx, applied); err != nil {
+			return err
 		}
-		r.deleteConnectorQueue.Forget(obj)
-		return nil
-	}(obj)
+		return r.releaseFinalizer(ctx, key)
+	case r.finalizer != "" && cachedConnector.DeletionTimestamp != nil:
+		return r.finalizeConnector(ctx, cachedConnector)
+	case applied == nil:
+		return r.handleAddConnector(ctx, key, cachedConnector)
+	case r.connectorChanged(applied, cachedConnector):
+		return r.handleUpdateConnector(ctx, key, applied, cachedConnector)
+	}
+	return nil
+}
+
+// reconcileConnector hands the current state of the connector to the reconciler, a nil
+// connector is passed once the connector is deleted.
+func (r *runtime) reconcileConnector(ctx context.Context, key string, cachedConnector *vanusv1alpha1.Connector) (Result, error) {
+	if cachedConnector == nil || (r.finalizer != "" && cachedConnector.DeletionTimestamp != nil) {
+		if r.getApplied(key) == nil && (cachedConnector == nil || !hasFinalizer(cachedConnector, r.finalizer)) {
+			return Result{}, nil
+		}
+		log.Infof("reconcile deleted connector %s", key)
+		var result Result
+		err := observeHandler(operationReconcile, r.getApplied(key), func() (err error) {
+			result, err = r.reconciler.Reconcile(ctx, key, nil)
+			return err
+		})
+		if err != nil {
+			log.Errorf("reconcile deleted connector %s failed: %+v", key, err)
+			return result, err
+		}
+		r.deleteApplied(key)
+		r.forgetConnector(key)
+		if cachedConnector != nil {
+			err = r.updateFinalizers(ctx, key, func(connector *vanusv1alpha1.Connector) bool {
+				return removeFinalizer(connector, r.finalizer)
+			})
+		} else {
+			err = r.releaseFinalizer(ctx, key)
+		}
+		return result, err
+	}
 
+	if r.finalizer != "" {
+		if err := r.ensureFinalizer(ctx, key); err != nil {
+			return Result{}, err
+		}
+	}
+	if cachedConnector.Status.Phase == "" {
+		r.recordPending(ctx, key)
+	}
+	log.Infof("reconcile connector %s", key)
+	var result Result
+	err := observeHandler(operationReconcile, cachedConnector, func() (err error) {
+		result, err = r.reconciler.Reconcile(ctx, key, cachedConnector.DeepCopy())
+		return err
+	})
 	if err != nil {
-		utilruntime.HandleError(err)
-		return true
+		r.recordResult(ctx, key, cachedConnector.Generation, reasonReconcileFailed, err)
+		log.Errorf("reconcile connector %s failed: %+v", key, err)
+		return result, err
 	}
-	return true
+	r.setApplied(key, cachedConnector)
+	r.recordResult(ctx, key, cachedConnector.Generation, reasonReconciled, nil)
+	return result, nil
 }
 
-func (r *runtime) handleAddConnector(key string) error {
+func (r *runtime) handleAddConnector(ctx context.Context, key string, cachedConnector *vanusv1alpha1.Connector) error {
 	var err error
-	cachedConnector, err := r.connectorsLister.Get(key)
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			return nil
+	if r.finalizer != "" {
+		if err = r.ensureFinalizer(ctx, key); err != nil {
+			return err
 		}
-		return err
+	}
+	if cachedConnector.Status.Phase == "" {
+		r.recordPending(ctx, key)
 	}
 	log.Infof("handle add connector %s", cachedConnector.Name)
-	err = r.handler.OnAdd(cachedConnector.Name, cachedConnector.Spec.Config)
+	err = observeHandler(operationAdd, cachedConnector, func() error {
+		return r.handler.OnAdd(ctx, cachedConnector.DeepCopy())
+	})
 	if err != nil {
+		r.recordResult(ctx, key, cachedConnector.Generation, reasonAddFailed, err)
 		log.Errorf("handle add connector %s failed: %+v", cachedConnector.Name, err)
 		return err
 	}
+	r.setApplied(key, cachedConnector)
+	r.recordResult(ctx, key, cachedConnector.Generation, reasonStarted, nil)
 	return nil
 }
 
-func (r *runtime) handleUpdateConnector(key string) error {
+func (r *runtime) handleUpdateConnector(ctx context.Context, key string, applied, cachedConnector *vanusv1alpha1.Connector) error {
 	var err error
-	cachedConnector, err := r.connectorsLister.Get(key)
-	if err != nil {
-		if k8serrors.IsNotFound(err) {
-			return nil
+	if r.finalizer != "" {
+		if err = r.ensureFinalizer(ctx, key); err != nil {
+			return err
 		}
-		return err
 	}
 	log.Infof("handle update connector %s", cachedConnector.Name)
-	err = r.handler.OnUpdate(cachedConnector.Name, cachedConnector.Spec.Config)
+	err = observeHandler(operationUpdate, cachedConnector, func() error {
+		return r.handler.OnUpdate(ctx, applied.DeepCopy(), cachedConnector.DeepCopy())
+	})
 	if err != nil {
+		r.recordResult(ctx, key, cachedConnector.Generation, reasonUpdateFailed, err)
 		log.Errorf("handle update connector %s failed: %+v", cachedConnector.Name, err)
 		return err
 	}
+	r.setApplied(key, cachedConnector)
+	r.recordResult(ctx, key, cachedConnector.Generation, reasonUpdated, nil)
 	return nil
 }
 
-func (r *runtime) handleDeleteConnector(connector *vanusv1alpha1.Connector) error {
+func (r *runtime) handleDeleteConnector(ctx context.Context, connector *vanusv1alpha1.Connector) error {
 	log.Infof("handle delete connector %s", connector.Name)
-	err := r.handler.OnDelete(connector.Name)
+	err := observeHandler(operationDelete, connector, func() error {
+		return r.handler.OnDelete(ctx, connector.DeepCopy())
+	})
 	if err != nil {
 		log.Errorf("handle delete connector %s failed: %+v", connector.Name, err)
 		return err
 	}
+	r.deleteApplied(connector.Name)
+	r.forgetConnector(connector.Name)
 	return nil
 }
+
+// forgetConnector drops the state kept for a connector no longer running.
+func (r *runtime) forgetConnector(key string) {
+	r.reporter.forget(key)
+	r.metrics.phases.forget(key)
+}
+
+func (r *runtime) getApplied(key string) *vanusv1alpha1.Connector {
+	r.appliedLock.RLock()
+	defer r.appliedLock.RUnlock()
+	return r.applied[key]
+}
+
+func (r *runtime) setApplied(key string, connector *vanusv1alpha1.Connector) {
+	r.appliedLock.Lock()
+	defer r.appliedLock.Unlock()
+	r.applied[key] = connector
+}
+
+func (r *runtime) deleteApplied(key string) {
+	r.appliedLock.Lock()
+	defer r.appliedLock.Unlock()
+	delete(r.applied, key)
+}
+
+// connectorChanged returns true if the effective definition of the connector changed since it
+// was applied to the handler. Changes of metadata are ignored unless they are watched explicitly.
+func (r *runtime) connectorChanged(applied, connector *vanusv1alpha1.Connector) bool {
+	if applied.ResourceVersion == connector.ResourceVersion {
+		return false
+	}
+	// generation is only bumped when the spec changed, fall back to comparing the spec for
+	// backends which don't maintain the generation
+	if applied.Generation == 0 || applied.Generation != connector.Generation {
+		if !equality.Semantic.DeepEqual(applied.Spec, connector.Spec) {
+			return true
+		}
+	}
+	if r.watchLabels && !reflect.DeepEqual(applied.Labels, connector.Labels) {
+		return true
+	}
+	for _, key := range r.watchAnnotations {
+		if applied.Annotations[key] != connector.Annotations[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// writtenByRuntime returns true if the connector only changed in the fields written by
+// runtime itself, i.e. the status and the finalizers.
+func writtenByRuntime(old, new *vanusv1alpha1.Connector) bool {
+	if old.ResourceVersion == new.ResourceVersion || old.Generation != new.Generation {
+		return false
+	}
+	oldCopy, newCopy := old.DeepCopy(), new.DeepCopy()
+	for _, connector := range []*vanusv1alpha1.Connector{oldCopy, newCopy} {
+		connector.ResourceVersion = ""
+		connector.ManagedFields = nil
+		connector.Finalizers = nil
+		connector.Status = vanusv1alpha1.ConnectorStatus{}
+	}
+	return reflect.DeepEqual(oldCopy, newCopy)
+}
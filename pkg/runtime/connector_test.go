@@ -0,0 +1,459 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+// runRuntime runs a runtime until the test finishes.
+func runRuntime(t *testing.T, opts ...runtime.ConnectorOption) runtime.Runtime {
+	t.Helper()
+	r, err := runtime.New(opts...)
+	if err != nil {
+		t.Fatalf("failed to create runtime: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("runtime failed: %v", err)
+		}
+	})
+	readyCtx, readyCancel := context.WithTimeout(ctx, runtimetest.DefaultTimeout)
+	defer readyCancel()
+	if err = r.WaitForReady(readyCtx); err != nil {
+		t.Fatalf("runtime is not ready: %v", err)
+	}
+	return r
+}
+
+// missedDeleteStore drops the delete notifications while dropping is set, the runtime is told
+// by a tombstone instead like an informer missing them.
+type missedDeleteStore struct {
+	*runtimetest.Store
+	dropping *atomic.Bool
+	handler  cache.ResourceEventHandler
+}
+
+func (s *missedDeleteStore) AddEventHandler(handler cache.ResourceEventHandler) error {
+	s.handler = handler
+	return s.Store.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    handler.OnAdd,
+		UpdateFunc: handler.OnUpdate,
+		DeleteFunc: func(obj interface{}) {
+			if !s.dropping.Load() {
+				handler.OnDelete(obj)
+			}
+		},
+	})
+}
+
+func waitForDeleted(t *testing.T, deleted <-chan string, want string) {
+	t.Helper()
+	select {
+	case name := <-deleted:
+		if name != want {
+			t.Fatalf("unexpected connector %s deleted, want %s", name, want)
+		}
+	case <-time.After(runtimetest.DefaultTimeout):
+		t.Fatalf("timeout waiting for connector %s to be deleted", want)
+	}
+}
+
+func TestTombstoneDeleted(t *testing.T) {
+	connector := &vanusv1alpha1.Connector{}
+	connector.Name = "a"
+	tests := []struct {
+		name string
+		obj  interface{}
+	}{
+		{name: "final state", obj: connector},
+		{name: "nil final state", obj: nil},
+		{name: "unknown final state", obj: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &missedDeleteStore{Store: runtimetest.NewStore(), dropping: &atomic.Bool{}}
+			added := make(chan string, 1)
+			deleted := make(chan string, 1)
+			runRuntime(t, runtime.WithStore(store), runtime.WithHandler(runtime.ConnectorHandlerFuncs{
+				AddFunc: func(_ context.Context, connector *vanusv1alpha1.Connector) error {
+					added <- connector.Name
+					return nil
+				},
+				DeleteFunc: func(_ context.Context, connector *vanusv1alpha1.Connector) error {
+					deleted <- connector.Name
+					return nil
+				},
+			}))
+
+			if _, err := store.Create(context.Background(), connector.DeepCopy()); err != nil {
+				t.Fatalf("failed to create connector: %v", err)
+			}
+			<-added
+			store.dropping.Store(true)
+			if err := store.Delete(context.Background(), "a"); err != nil {
+				t.Fatalf("failed to delete connector: %v", err)
+			}
+			store.handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "a", Obj: tt.obj})
+			waitForDeleted(t, deleted, "a")
+		})
+	}
+}
+
+// activeHandlerFuncs is a handler running the given connectors already.
+type activeHandlerFuncs struct {
+	runtime.ConnectorHandlerFuncs
+	active []string
+}
+
+func (h activeHandlerFuncs) ActiveConnectors(context.Context) ([]string, error) {
+	return h.active, nil
+}
+
+func TestOrphanConnectorsDeletedAtStartup(t *testing.T) {
+	store := runtimetest.NewStore()
+	connector := &vanusv1alpha1.Connector{}
+	connector.Name = "a"
+	if _, err := store.Create(context.Background(), connector); err != nil {
+		t.Fatalf("failed to create connector: %v", err)
+	}
+	deleted := make(chan string, 2)
+	runRuntime(t, runtime.WithStore(store), runtime.WithHandler(activeHandlerFuncs{
+		ConnectorHandlerFuncs: runtime.ConnectorHandlerFuncs{
+			DeleteFunc: func(_ context.Context, connector *vanusv1alpha1.Connector) error {
+				deleted <- connector.Name
+				return nil
+			},
+		},
+		active: []string{"a", "ghost"},
+	}))
+
+	// only the connector which no longer exists is deleted
+	waitForDeleted(t, deleted, "ghost")
+	select {
+	case name := <-deleted:
+		t.Fatalf("existing connector %s is deleted", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// serialHandler fails the test if it's called for a connector concurrently.
+type serialHandler struct {
+	t        *testing.T
+	mu       sync.Mutex
+	inFlight map[string]bool
+}
+
+func (h *serialHandler) call(connector *vanusv1alpha1.Connector) error {
+	h.mu.Lock()
+	if h.inFlight[connector.Name] {
+		h.t.Errorf("handler called for connector %s concurrently", connector.Name)
+	}
+	h.inFlight[connector.Name] = true
+	h.mu.Unlock()
+	// widen the window of a concurrent call
+	time.Sleep(time.Millisecond)
+	h.mu.Lock()
+	delete(h.inFlight, connector.Name)
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *serialHandler) OnAdd(_ context.Context, connector *vanusv1alpha1.Connector) error {
+	return h.call(connector)
+}
+
+func (h *serialHandler) OnUpdate(_ context.Context, _, new *vanusv1alpha1.Connector) error {
+	return h.call(new)
+}
+
+func (h *serialHandler) OnDelete(_ context.Context, connector *vanusv1alpha1.Connector) error {
+	return h.call(connector)
+}
+
+func TestDeleteWhileAddRetrying(t *testing.T) {
+	h := runtimetest.New(t, &serialHandler{t: t, inFlight: map[string]bool{}}, runtime.WithWorkers(4))
+	boom := errors.New("boom")
+
+	// a is deleted before its add ever succeeds
+	h.FailNext(runtimetest.EventAdd, "a", 3, boom)
+	// b is changed and deleted while its add is retried, and the retry succeeds
+	h.FailNext(runtimetest.EventAdd, "b", 1, boom)
+	h.Create(newConnector("a", nil))
+	h.Create(newConnector("b", nil))
+	h.WaitForEvents(2)
+	for i := 0; i < 3; i++ {
+		connector := h.Get("b")
+		connector.Spec.Config = fmt.Sprintf("v%d", i)
+		h.Update(connector)
+	}
+	h.Delete("a")
+	h.Step(5 * time.Millisecond)
+	h.WaitForObserved("b")
+	h.WaitForIdle()
+	h.Delete("b")
+	h.WaitForObserved("b")
+	h.Step(time.Second)
+	h.WaitForIdle()
+
+	added := map[string]bool{}
+	var calls []runtimetest.Event
+	for _, event := range h.Events() {
+		switch {
+		case event.Type == runtimetest.EventAdd && event.Err == nil:
+			added[event.ConnectorID] = true
+		case event.Type == runtimetest.EventUpdate || event.Type == runtimetest.EventDelete:
+			if !added[event.ConnectorID] {
+				t.Fatalf("connector %s is updated or deleted before added: %v", event.ConnectorID, h.Events())
+			}
+		}
+		if event.ConnectorID == "a" {
+			calls = append(calls, event)
+		}
+	}
+	// a is not retried once deleted, and nothing is deleted from the handler
+	if len(calls) != 1 || calls[0].Type != runtimetest.EventAdd || calls[0].Err == nil {
+		t.Fatalf("unexpected invocations of connector a: %v", calls)
+	}
+	// b is added with the latest spec and deleted
+	var last runtimetest.Event
+	for _, event := range h.Events() {
+		if event.ConnectorID == "b" && event.Type == runtimetest.EventAdd && event.Err == nil {
+			last = event
+		}
+	}
+	if last.Generation != 4 {
+		t.Fatalf("connector b is added with generation %d, want 4", last.Generation)
+	}
+	if events := h.Events(); events[len(events)-1].Type != runtimetest.EventDelete ||
+		events[len(events)-1].ConnectorID != "b" {
+		t.Fatalf("connector b is not deleted at last: %v", events)
+	}
+}
+
+func TestConnectorChanged(t *testing.T) {
+	applied := newConnector("a", map[string]string{"team": "a"})
+	applied.ResourceVersion = "1"
+	applied.Generation = 1
+	applied.Annotations = map[string]string{"watched": "1", "other": "1"}
+
+	for _, tc := range []struct {
+		name string
+		edit func(connector *vanusv1alpha1.Connector)
+		// changed and changedWatching are whether the connector changed without and with the
+		// labels and the annotation watched
+		changed, changedWatching bool
+	}{
+		{
+			name: "resync",
+			edit: func(connector *vanusv1alpha1.Connector) {},
+		},
+		{
+			name: "resync with metadata changed",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.ResourceVersion = "1"
+				connector.Labels = nil
+				connector.Spec.Config = "v2"
+			},
+		},
+		{
+			name: "spec",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Generation++
+				connector.Spec.Config = "v2"
+			},
+			changed:         true,
+			changedWatching: true,
+		},
+		{
+			name: "spec without generation",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Generation = 0
+				connector.Spec.Config = "v2"
+			},
+			changed:         true,
+			changedWatching: true,
+		},
+		{
+			name: "status",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Status.Phase = vanusv1alpha1.ConnectorRunning
+			},
+		},
+		{
+			name: "finalizers",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Finalizers = []string{runtime.DefaultFinalizer}
+			},
+		},
+		{
+			name: "labels",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Labels = map[string]string{"team": "b"}
+			},
+			changedWatching: true,
+		},
+		{
+			name: "watched annotation",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Annotations = map[string]string{"watched": "2", "other": "1"}
+			},
+			changedWatching: true,
+		},
+		{
+			name: "other annotation",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Annotations = map[string]string{"watched": "1", "other": "2"}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			connector := applied.DeepCopy()
+			connector.ResourceVersion = "2"
+			tc.edit(connector)
+			for _, watching := range []bool{false, true} {
+				opts := []runtime.ConnectorOption{
+					runtime.WithStore(runtimetest.NewStore()),
+					runtime.WithHandler(runtime.ConnectorHandlerFuncs{}),
+				}
+				want := tc.changed
+				if watching {
+					opts = append(opts, runtime.WithWatchLabels(), runtime.WithWatchAnnotations("watched"))
+					want = tc.changedWatching
+				}
+				r, err := runtime.New(opts...)
+				if err != nil {
+					t.Fatalf("failed to create runtime: %v", err)
+				}
+				if got := runtime.ConnectorChanged(r, applied, connector); got != want {
+					t.Errorf("connector changed %t with watching %t, want %t", got, watching, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWrittenByRuntime(t *testing.T) {
+	old := newConnector("a", map[string]string{"team": "a"})
+	old.ResourceVersion = "1"
+	old.Generation = 1
+
+	for _, tc := range []struct {
+		name string
+		edit func(connector *vanusv1alpha1.Connector)
+		want bool
+	}{
+		{
+			name: "resync",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.ResourceVersion = "1"
+			},
+		},
+		{
+			name: "status",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Status.Phase = vanusv1alpha1.ConnectorRunning
+			},
+			want: true,
+		},
+		{
+			name: "finalizers",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Finalizers = []string{runtime.DefaultFinalizer}
+			},
+			want: true,
+		},
+		{
+			name: "status and finalizers",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Finalizers = []string{runtime.DefaultFinalizer}
+				connector.Status.Phase = vanusv1alpha1.ConnectorRunning
+			},
+			want: true,
+		},
+		{
+			name: "spec",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Generation++
+				connector.Spec.Config = "v2"
+			},
+		},
+		{
+			name: "labels",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Labels = map[string]string{"team": "b"}
+			},
+		},
+		{
+			name: "annotations",
+			edit: func(connector *vanusv1alpha1.Connector) {
+				connector.Annotations = map[string]string{"key": "value"}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			connector := old.DeepCopy()
+			connector.ResourceVersion = "2"
+			tc.edit(connector)
+			if got := runtime.WrittenByRuntime(old, connector); got != tc.want {
+				t.Fatalf("written by runtime %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWatchLabels(t *testing.T) {
+	for _, watching := range []bool{false, true} {
+		var opts []runtime.ConnectorOption
+		if watching {
+			opts = append(opts, runtime.WithWatchLabels())
+		}
+		h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{}, opts...)
+
+		h.Create(newConnector("a", map[string]string{"team": "a"}))
+		h.WaitForObserved("a")
+		h.WaitForIdle()
+		connector := h.Get("a")
+		connector.Labels = map[string]string{"team": "b"}
+		h.Update(connector)
+		// the status written by the runtime is ignored either way
+		h.WaitForIdle()
+		want := []runtimetest.Event{{Type: runtimetest.EventAdd, ConnectorID: "a", Generation: 1}}
+		if watching {
+			h.WaitForEvents(2)
+			h.WaitForIdle()
+			want = append(want, runtimetest.Event{Type: runtimetest.EventUpdate, ConnectorID: "a", Generation: 1})
+		}
+		h.ExpectEvents(want...)
+	}
+}
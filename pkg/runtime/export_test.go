@@ -0,0 +1,76 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"time"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+)
+
+// RenewConnectorLeases renews the connector leases held by r without waiting for the period.
+func RenewConnectorLeases(ctx context.Context, r Runtime) {
+	r.(*runtime).leases.renewAll(ctx)
+}
+
+// SyncSharder renews the member lease of r and refreshes the members of its shard group
+// without waiting for the period.
+func SyncSharder(ctx context.Context, r Runtime) {
+	r.(*runtime).sharder.sync(ctx)
+}
+
+// ShardOwns returns true if the connector is owned by r in its shard group.
+func ShardOwns(r Runtime, key string) bool {
+	return r.(*runtime).sharder.owns(key)
+}
+
+// ConnectorChanged returns true if r handles connector as an update of the applied one.
+func ConnectorChanged(r Runtime, applied, connector *vanusv1alpha1.Connector) bool {
+	return r.(*runtime).connectorChanged(applied, connector)
+}
+
+// WrittenByRuntime returns true if the update from old to new is ignored as written by the
+// runtime itself.
+func WrittenByRuntime(old, new *vanusv1alpha1.Connector) bool {
+	return writtenByRuntime(old, new)
+}
+
+// Backoff returns the delay of p after the given number of previous failures.
+func Backoff(p RetryPolicy, failures int) time.Duration {
+	return p.backoff(failures)
+}
+
+// WithLeaderElectionPeriods sets the durations of leader election, the option must follow
+// WithLeaderElection.
+func WithLeaderElectionPeriods(leaseDuration, renewDeadline, retryPeriod time.Duration) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.leaderElection.leaseDuration = leaseDuration
+		opt.leaderElection.renewDeadline = renewDeadline
+		opt.leaderElection.retryPeriod = retryPeriod
+	}
+}
+
+// WithoutPeriodicSync disables the periodic sync of the sharder and the connector leases, they
+// are driven by SyncSharder and RenewConnectorLeases instead. The option must follow
+// WithSharding.
+func WithoutPeriodicSync() ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.leasePeriod = 0
+		if opt.sharding != nil {
+			opt.sharding.period = 0
+		}
+	}
+}
@@ -0,0 +1,543 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/tools/cache"
+	log "k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	vanuslister "github.com/vanus-labs/vanus-connect-runtime/pkg/client/listers/vanus/v1alpha1"
+)
+
+const (
+	// statusFileSuffix is the suffix of the sidecar files the status of connectors is
+	// written to, the status of connector foo is written to foo.status.yaml.
+	statusFileSuffix = ".status.yaml"
+	// fileStoreDebounce is how long the changes of a file are coalesced before it's
+	// reloaded, editors usually replace a file by several operations.
+	fileStoreDebounce = 100 * time.Millisecond
+)
+
+// fileStore is the Store loading connector manifests from the YAML or JSON files of a
+// directory, it watches the directory by inotify so the connectors are added, updated and
+// deleted as the files are created, edited and removed. A file may contain several
+// connectors separated by "---".
+//
+// The manifests are never written by the store: the status of a connector is written to
+// the sidecar file <name>.status.yaml, and finalizers only live in memory, a connector
+// with finalizers is marked deleting when its manifest is removed and deleted once its
+// finalizers are removed.
+type fileStore struct {
+	dir      string
+	selector labels.Selector
+	indexer  cache.Indexer
+	lister   vanuslister.ConnectorLister
+
+	// lock guards the state below, it's held while notifying handlers so the events are
+	// delivered in order
+	lock     sync.Mutex
+	handlers []cache.ResourceEventHandler
+	// files is the names of the connectors loaded from each file
+	files map[string][]string
+	// owners is the file each connector is loaded from
+	owners map[string]string
+	// conflicts is the file each connector was skipped in because it's loaded from another
+	// file, the file is synced again once the connector is released, e.g. when it's renamed
+	conflicts map[string]string
+	// recreated is the connectors whose manifest was recreated while they were deleting,
+	// they are added again once deleted
+	recreated       map[string]*vanusv1alpha1.Connector
+	resourceVersion uint64
+
+	synced   atomic.Bool
+	watcher  *fsnotify.Watcher
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewFileStore returns a Store loading the connectors from the manifests in dir.
+func NewFileStore(dir string) Store {
+	return newFileStore(dir, labels.Everything())
+}
+
+func newFileStore(dir string, selector labels.Selector) *fileStore {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	return &fileStore{
+		dir:       dir,
+		selector:  selector,
+		indexer:   indexer,
+		lister:    vanuslister.NewConnectorLister(indexer),
+		files:     map[string][]string{},
+		owners:    map[string]string{},
+		conflicts: map[string]string{},
+		recreated: map[string]*vanusv1alpha1.Connector{},
+		stopCh:    make(chan struct{}),
+	}
+}
+
+func (s *fileStore) AddEventHandler(handler cache.ResourceEventHandler) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.handlers = append(s.handlers, handler)
+	return nil
+}
+
+func (s *fileStore) Start(_ context.Context) error {
+	info, err := os.Stat(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to stat connector directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.dir)
+	}
+	// watch before listing the directory so no change is missed
+	if s.watcher, err = fsnotify.NewWatcher(); err != nil {
+		return fmt.Errorf("failed to create watcher: %w", err)
+	}
+	if err = s.watcher.Add(s.dir); err != nil {
+		_ = s.watcher.Close()
+		return fmt.Errorf("failed to watch connector directory: %w", err)
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		_ = s.watcher.Close()
+		return fmt.Errorf("failed to read connector directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && isManifestFile(entry.Name()) {
+			s.syncFile(filepath.Join(s.dir, entry.Name()))
+		}
+	}
+	s.synced.Store(true)
+	go s.run()
+	return nil
+}
+
+func (s *fileStore) run() {
+	pending := map[string]struct{}{}
+	timer := time.NewTimer(fileStoreDebounce)
+	timer.Stop()
+	for {
+		select {
+		case <-s.stopCh:
+			timer.Stop()
+			return
+		case event, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			if !isManifestFile(filepath.Base(event.Name)) {
+				continue
+			}
+			pending[event.Name] = struct{}{}
+			timer.Reset(fileStoreDebounce)
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("watch connector directory %s error: %+v", s.dir, err)
+		case <-timer.C:
+			for path := range pending {
+				s.syncFile(path)
+			}
+			pending = map[string]struct{}{}
+		}
+	}
+}
+
+func (s *fileStore) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+		if s.watcher != nil {
+			_ = s.watcher.Close()
+		}
+	})
+}
+
+func (s *fileStore) HasSynced() bool {
+	return s.synced.Load()
+}
+
+func (s *fileStore) Lister() vanuslister.ConnectorLister {
+	return s.lister
+}
+
+func (s *fileStore) Get(_ context.Context, name string) (*vanusv1alpha1.Connector, error) {
+	connector, err := s.lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return connector.DeepCopy(), nil
+}
+
+// Update only updates the finalizers of the connector, the manifests are never written.
+func (s *fileStore) Update(_ context.Context, connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, err := s.current(connector)
+	if err != nil {
+		return nil, err
+	}
+	if old.DeletionTimestamp != nil && len(connector.Finalizers) == 0 {
+		// the manifest is still there if the connector was relabeled out of the selector, the
+		// status of a recreated connector starts over
+		_, owned := s.owners[old.Name]
+		recreated, ok := s.recreated[old.Name]
+		s.delete(old, !owned || ok)
+		if ok {
+			delete(s.recreated, old.Name)
+			s.apply(recreated)
+		}
+		return connector.DeepCopy(), nil
+	}
+	newConnector := old.DeepCopy()
+	newConnector.Finalizers = connector.Finalizers
+	s.update(old, newConnector)
+	return newConnector.DeepCopy(), nil
+}
+
+// UpdateStatus updates the status of the connector and writes it to the sidecar status file.
+func (s *fileStore) UpdateStatus(_ context.Context, connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	old, err := s.current(connector)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.writeStatus(connector.Name, &connector.Status); err != nil {
+		return nil, err
+	}
+	newConnector := old.DeepCopy()
+	connector.Status.DeepCopyInto(&newConnector.Status)
+	s.update(old, newConnector)
+	return newConnector.DeepCopy(), nil
+}
+
+func (s *fileStore) WithFilter(filter string) (Store, error) {
+	selector, err := labels.Parse(filter)
+	if err != nil {
+		return nil, err
+	}
+	return newFileStore(s.dir, selector), nil
+}
+
+// current returns the stored connector, or an error if connector is stale.
+func (s *fileStore) current(connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error) {
+	old, err := s.lister.Get(connector.Name)
+	if err != nil {
+		return nil, err
+	}
+	if connector.ResourceVersion != old.ResourceVersion {
+		return nil, k8serrors.NewConflict(vanusv1alpha1.Resource("connectors"), connector.Name,
+			errors.New("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	return old, nil
+}
+
+// syncFile reloads the connectors of the file, the connectors are deleted if the file has
+// been removed. A file which failed to parse is skipped, its connectors are kept until it's
+// fixed.
+func (s *fileStore) syncFile(path string) {
+	for _, conflicting := range s.loadFile(path) {
+		s.syncFile(conflicting)
+	}
+}
+
+// loadFile reloads the connectors of the file, it returns the files which have to be synced
+// again because a connector they define has been released by this file.
+func (s *fileStore) loadFile(path string) []string {
+	connectors, err := readManifests(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("failed to load connectors from %s: %+v", path, err)
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	names := make([]string, 0, len(connectors))
+	loaded := map[string]struct{}{}
+	for _, connector := range connectors {
+		if owner, ok := s.owners[connector.Name]; ok && owner != path {
+			log.Errorf("connector %s in %s is already loaded from %s, skipped", connector.Name, path, owner)
+			s.conflicts[connector.Name] = path
+			continue
+		}
+		if _, ok := loaded[connector.Name]; ok {
+			log.Errorf("connector %s is defined more than once in %s, skipped", connector.Name, path)
+			continue
+		}
+		loaded[connector.Name] = struct{}{}
+		names = append(names, connector.Name)
+		s.owners[connector.Name] = path
+		if s.conflicts[connector.Name] == path {
+			delete(s.conflicts, connector.Name)
+		}
+		s.apply(connector)
+	}
+	var resync []string
+	for _, name := range s.files[path] {
+		if _, ok := loaded[name]; ok {
+			continue
+		}
+		delete(s.owners, name)
+		if old, err := s.lister.Get(name); err == nil {
+			s.remove(old, true)
+		}
+		if conflicting, ok := s.conflicts[name]; ok {
+			delete(s.conflicts, name)
+			resync = append(resync, conflicting)
+		}
+	}
+	if len(names) == 0 {
+		delete(s.files, path)
+	} else {
+		s.files[path] = names
+	}
+	return resync
+}
+
+// apply adds or updates the connector loaded from a manifest.
+func (s *fileStore) apply(connector *vanusv1alpha1.Connector) {
+	old, err := s.lister.Get(connector.Name)
+	if err != nil {
+		if !s.selector.Matches(labels.Set(connector.Labels)) {
+			return
+		}
+		connector.UID = uuid.NewUUID()
+		connector.Generation = 1
+		connector.CreationTimestamp = metav1.Now()
+		if status, err := s.readStatus(connector.Name); err != nil {
+			log.Errorf("failed to load status of connector %s: %+v", connector.Name, err)
+		} else if status != nil {
+			connector.Status = *status
+		}
+		s.add(connector)
+		return
+	}
+	if old.DeletionTimestamp != nil {
+		s.recreated[connector.Name] = connector
+		return
+	}
+	if !s.selector.Matches(labels.Set(connector.Labels)) {
+		// relabeled out of the selector, the status is kept along with the manifest
+		s.remove(old, false)
+		return
+	}
+	if equality.Semantic.DeepEqual(old.Spec, connector.Spec) &&
+		equality.Semantic.DeepEqual(old.Labels, connector.Labels) &&
+		equality.Semantic.DeepEqual(old.Annotations, connector.Annotations) {
+		return
+	}
+	newConnector := old.DeepCopy()
+	newConnector.Labels = connector.Labels
+	newConnector.Annotations = connector.Annotations
+	if !equality.Semantic.DeepEqual(old.Spec, connector.Spec) {
+		newConnector.Spec = connector.Spec
+		newConnector.Generation++
+	}
+	s.update(old, newConnector)
+}
+
+// remove deletes the connector whose manifest has been removed or which has been relabeled
+// out of the selector, it's only marked deleting if it has finalizers. The status file is only
+// removed along with the manifest.
+func (s *fileStore) remove(old *vanusv1alpha1.Connector, manifestRemoved bool) {
+	delete(s.recreated, old.Name)
+	if len(old.Finalizers) == 0 {
+		s.delete(old, manifestRemoved)
+		return
+	}
+	if old.DeletionTimestamp != nil {
+		return
+	}
+	newConnector := old.DeepCopy()
+	now := metav1.Now()
+	newConnector.DeletionTimestamp = &now
+	s.update(old, newConnector)
+}
+
+func (s *fileStore) add(connector *vanusv1alpha1.Connector) {
+	connector.ResourceVersion = s.nextResourceVersion()
+	_ = s.indexer.Add(connector)
+	for _, handler := range s.handlers {
+		handler.OnAdd(connector)
+	}
+}
+
+func (s *fileStore) update(old, connector *vanusv1alpha1.Connector) {
+	connector.ResourceVersion = s.nextResourceVersion()
+	_ = s.indexer.Update(connector)
+	for _, handler := range s.handlers {
+		handler.OnUpdate(old, connector)
+	}
+}
+
+func (s *fileStore) delete(connector *vanusv1alpha1.Connector, removeStatus bool) {
+	_ = s.indexer.Delete(connector)
+	if removeStatus {
+		if err := os.Remove(s.statusFile(connector.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("failed to remove status file of connector %s: %+v", connector.Name, err)
+		}
+	}
+	for _, handler := range s.handlers {
+		handler.OnDelete(connector)
+	}
+}
+
+func (s *fileStore) nextResourceVersion() string {
+	s.resourceVersion++
+	return strconv.FormatUint(s.resourceVersion, 10)
+}
+
+func (s *fileStore) statusFile(name string) string {
+	return filepath.Join(s.dir, name+statusFileSuffix)
+}
+
+func (s *fileStore) readStatus(name string) (*vanusv1alpha1.ConnectorStatus, error) {
+	data, err := os.ReadFile(s.statusFile(name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	status := &vanusv1alpha1.ConnectorStatus{}
+	if err = yaml.Unmarshal(data, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// writeStatus writes the status file by renaming a temporary file, so it's never read
+// partially written.
+func (s *fileStore) writeStatus(name string, status *vanusv1alpha1.ConnectorStatus) error {
+	data, err := yaml.Marshal(status)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, "."+name+statusFileSuffix+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.statusFile(name))
+}
+
+// isManifestFile returns true if the file is a connector manifest rather than a status file,
+// a hidden file or a backup of an editor.
+func isManifestFile(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, statusFileSuffix) {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// readManifests decodes the connectors of a manifest file.
+func readManifests(path string) ([]*vanusv1alpha1.Connector, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var connectors []*vanusv1alpha1.Connector
+	decoder := utilyaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		connector := &vanusv1alpha1.Connector{}
+		if err = decoder.Decode(connector); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if connector.Name == "" && connector.Kind == "" && connector.APIVersion == "" {
+			// empty document
+			continue
+		}
+		if err = validateManifest(connector); err != nil {
+			return nil, err
+		}
+		connectors = append(connectors, manifestConnector(connector))
+	}
+	sort.Slice(connectors, func(i, j int) bool {
+		return connectors[i].Name < connectors[j].Name
+	})
+	return connectors, nil
+}
+
+func validateManifest(connector *vanusv1alpha1.Connector) error {
+	if connector.APIVersion != "" && connector.APIVersion != vanusv1alpha1.SchemeGroupVersion.String() {
+		return fmt.Errorf("unsupported apiVersion %q", connector.APIVersion)
+	}
+	if connector.Kind != "" && connector.Kind != "Connector" {
+		return fmt.Errorf("unsupported kind %q", connector.Kind)
+	}
+	if connector.Name == "" {
+		return errors.New("connector name is required")
+	}
+	if strings.ContainsAny(connector.Name, `/\`) {
+		return fmt.Errorf("invalid connector name %q", connector.Name)
+	}
+	return nil
+}
+
+// manifestConnector returns the fields of the connector which are read from a manifest, the
+// rest is managed by the store.
+func manifestConnector(connector *vanusv1alpha1.Connector) *vanusv1alpha1.Connector {
+	return &vanusv1alpha1.Connector{
+		TypeMeta: connector.TypeMeta,
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        connector.Name,
+			Labels:      connector.Labels,
+			Annotations: connector.Annotations,
+		},
+		Spec: connector.Spec,
+	}
+}
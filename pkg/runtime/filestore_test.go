@@ -0,0 +1,286 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+)
+
+// manifest returns the manifest of a connector, labels are given as key=value pairs.
+func manifest(name, typ string, labels ...string) string {
+	var metadata strings.Builder
+	if len(labels) > 0 {
+		metadata.WriteString("  labels:\n")
+		for _, label := range labels {
+			key, value, _ := strings.Cut(label, "=")
+			fmt.Fprintf(&metadata, "    %s: %s\n", key, value)
+		}
+	}
+	return fmt.Sprintf(`apiVersion: vanus.ai/v1alpha1
+kind: Connector
+metadata:
+  name: %s
+%sspec:
+  kind: source
+  type: %s
+`, name, metadata.String(), typ)
+}
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+}
+
+// startFileStore starts a file store on dir, the store is stopped when the test finishes.
+func startFileStore(t *testing.T, store runtime.Store) {
+	t.Helper()
+	if err := store.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start file store: %v", err)
+	}
+	t.Cleanup(store.Stop)
+}
+
+// waitForConnector waits until the connector is stored and matches cond, or until it's not
+// stored if cond is nil.
+func waitForConnector(t *testing.T, store runtime.Store, name string, cond func(*vanusv1alpha1.Connector) bool) {
+	t.Helper()
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		connector, err := store.Lister().Get(name)
+		if cond == nil {
+			return err != nil, nil
+		}
+		return err == nil && cond(connector), nil
+	})
+	if err != nil {
+		connector, _ := store.Lister().Get(name)
+		t.Fatalf("timeout waiting for connector %s, got %+v", name, connector)
+	}
+}
+
+func hasType(typ string) func(*vanusv1alpha1.Connector) bool {
+	return func(connector *vanusv1alpha1.Connector) bool {
+		return connector.Spec.Type == typ
+	}
+}
+
+func TestFileStoreRename(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.yaml", manifest("c", "chatgpt"))
+	store := runtime.NewFileStore(dir)
+	startFileStore(t, store)
+	waitForConnector(t, store, "c", hasType("chatgpt"))
+
+	// the new file is skipped while the old one still defines the connector
+	writeFile(t, dir, "b.yaml", manifest("c", "http"))
+	time.Sleep(300 * time.Millisecond)
+	if err := os.Remove(filepath.Join(dir, "a.yaml")); err != nil {
+		t.Fatalf("failed to remove a.yaml: %v", err)
+	}
+	waitForConnector(t, store, "c", hasType("http"))
+
+	// both paths are synced in the same batch when the file is moved
+	if err := os.Rename(filepath.Join(dir, "b.yaml"), filepath.Join(dir, "d.yaml")); err != nil {
+		t.Fatalf("failed to rename b.yaml: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	waitForConnector(t, store, "c", hasType("http"))
+}
+
+// storeEvents records the events of a store.
+type storeEvents struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *storeEvents) record(format string, args ...interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, fmt.Sprintf(format, args...))
+}
+
+func (e *storeEvents) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.events...)
+}
+
+func (e *storeEvents) handler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			connector := obj.(*vanusv1alpha1.Connector)
+			e.record("add %s %d", connector.Name, connector.Generation)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			connector := obj.(*vanusv1alpha1.Connector)
+			e.record("update %s %d", connector.Name, connector.Generation)
+		},
+		DeleteFunc: func(obj interface{}) {
+			e.record("delete %s", obj.(*vanusv1alpha1.Connector).Name)
+		},
+	}
+}
+
+func expectStoreEvents(t *testing.T, events *storeEvents, want ...string) {
+	t.Helper()
+	if got := events.get(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected events %v, want %v", got, want)
+	}
+}
+
+func TestFileStoreLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	store := runtime.NewFileStore(dir)
+	events := &storeEvents{}
+	_ = store.AddEventHandler(events.handler())
+	startFileStore(t, store)
+
+	writeFile(t, dir, "a.yaml", manifest("a", "chatgpt"))
+	waitForConnector(t, store, "a", hasType("chatgpt"))
+	writeFile(t, dir, "a.yaml", manifest("a", "http"))
+	waitForConnector(t, store, "a", hasType("http"))
+	writeFile(t, dir, "a.yaml", manifest("a", "http", "app=demo"))
+	waitForConnector(t, store, "a", func(connector *vanusv1alpha1.Connector) bool {
+		return connector.Labels["app"] == "demo"
+	})
+	if err := os.Remove(filepath.Join(dir, "a.yaml")); err != nil {
+		t.Fatalf("failed to remove a.yaml: %v", err)
+	}
+	waitForConnector(t, store, "a", nil)
+
+	// only spec changes bump the generation
+	expectStoreEvents(t, events, "add a 1", "update a 2", "update a 2", "delete a")
+}
+
+func TestFileStoreMultiDocument(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "all.yaml", manifest("a", "chatgpt")+"---\n"+manifest("b", "http"))
+	store := runtime.NewFileStore(dir)
+	startFileStore(t, store)
+	waitForConnector(t, store, "a", hasType("chatgpt"))
+	waitForConnector(t, store, "b", hasType("http"))
+
+	writeFile(t, dir, "all.yaml", manifest("b", "http"))
+	waitForConnector(t, store, "a", nil)
+	waitForConnector(t, store, "b", hasType("http"))
+}
+
+func TestFileStoreParseErrorKeepsConnectors(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.yaml", manifest("a", "chatgpt")+"---\n"+manifest("b", "http"))
+	store := runtime.NewFileStore(dir)
+	events := &storeEvents{}
+	_ = store.AddEventHandler(events.handler())
+	startFileStore(t, store)
+	waitForConnector(t, store, "b", hasType("http"))
+
+	writeFile(t, dir, "a.yaml", manifest("a", "http")+"---\nmetadata: [")
+	time.Sleep(300 * time.Millisecond)
+	waitForConnector(t, store, "a", hasType("chatgpt"))
+	waitForConnector(t, store, "b", hasType("http"))
+	expectStoreEvents(t, events, "add a 1", "add b 1")
+
+	// the connectors are synced again once the file is fixed
+	writeFile(t, dir, "a.yaml", manifest("a", "http"))
+	waitForConnector(t, store, "a", hasType("http"))
+	waitForConnector(t, store, "b", nil)
+}
+
+func TestFileStoreStatusRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.yaml", manifest("a", "chatgpt"))
+	store := runtime.NewFileStore(dir)
+	startFileStore(t, store)
+	waitForConnector(t, store, "a", hasType("chatgpt"))
+
+	connector, err := store.Get(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("failed to get connector: %v", err)
+	}
+	connector.Status.Phase = vanusv1alpha1.ConnectorRunning
+	connector.Status.ObservedGeneration = 1
+	if _, err = store.UpdateStatus(context.Background(), connector); err != nil {
+		t.Fatalf("failed to update status: %v", err)
+	}
+	statusFile := filepath.Join(dir, "a.status.yaml")
+	if _, err = os.Stat(statusFile); err != nil {
+		t.Fatalf("status file is not written: %v", err)
+	}
+	// the status file is not loaded as a manifest
+	time.Sleep(300 * time.Millisecond)
+	if connectors, _ := store.Lister().List(labels.Everything()); len(connectors) != 1 {
+		t.Fatalf("unexpected connectors %v", connectors)
+	}
+	store.Stop()
+
+	// the status is loaded along with the manifest
+	store = runtime.NewFileStore(dir)
+	startFileStore(t, store)
+	waitForConnector(t, store, "a", func(connector *vanusv1alpha1.Connector) bool {
+		return connector.Status.Phase == vanusv1alpha1.ConnectorRunning && connector.Status.ObservedGeneration == 1
+	})
+
+	// and removed along with it
+	if err = os.Remove(filepath.Join(dir, "a.yaml")); err != nil {
+		t.Fatalf("failed to remove a.yaml: %v", err)
+	}
+	waitForConnector(t, store, "a", nil)
+	if _, err = os.Stat(statusFile); !os.IsNotExist(err) {
+		t.Fatalf("status file is kept after the manifest is removed: %v", err)
+	}
+}
+
+func TestFileStoreRelabelKeepsStatus(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "a.yaml", manifest("a", "chatgpt", "app=demo"))
+	store, err := runtime.NewFileStore(dir).(runtime.FilterableStore).WithFilter("app=demo")
+	if err != nil {
+		t.Fatalf("failed to filter file store: %v", err)
+	}
+	startFileStore(t, store)
+	waitForConnector(t, store, "a", hasType("chatgpt"))
+	connector, _ := store.Get(context.Background(), "a")
+	connector.Status.Phase = vanusv1alpha1.ConnectorRunning
+	if _, err = store.UpdateStatus(context.Background(), connector); err != nil {
+		t.Fatalf("failed to update status: %v", err)
+	}
+
+	writeFile(t, dir, "a.yaml", manifest("a", "chatgpt", "app=other"))
+	waitForConnector(t, store, "a", nil)
+	if _, err = os.Stat(filepath.Join(dir, "a.status.yaml")); err != nil {
+		t.Fatalf("status file is removed while the manifest exists: %v", err)
+	}
+	// the status is loaded again once the connector is relabeled back
+	writeFile(t, dir, "a.yaml", manifest("a", "chatgpt", "app=demo"))
+	waitForConnector(t, store, "a", func(connector *vanusv1alpha1.Connector) bool {
+		return connector.Status.Phase == vanusv1alpha1.ConnectorRunning
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"fmt"
+	"path"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	vanuslister "github.com/vanus-labs/vanus-connect-runtime/pkg/client/listers/vanus/v1alpha1"
+)
+
+// FilterConnector selects connectors on the client side, so it works with fields which are not
+// mirrored into labels. A connector is selected if it matches all the non-empty fields, the
+// zero value selects every connector.
+type FilterConnector struct {
+	// Kind matches the Spec.Kind of connector, it's merged into Kinds.
+	Kind string
+	// Type matches the Spec.Type of connector, it's merged into Types.
+	Type string
+	// Kinds matches connectors whose Spec.Kind is any of them.
+	Kinds []string
+	// Types matches connectors whose Spec.Type is any of them.
+	Types []string
+	// Names matches connectors whose name matches any of the glob patterns, see path.Match.
+	Names []string
+	// Predicate matches connectors for which it returns true.
+	Predicate func(connector *vanusv1alpha1.Connector) bool
+}
+
+func (f FilterConnector) validate() error {
+	for _, pattern := range f.Names {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid connector name pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Match returns true if the connector is selected by the filter.
+func (f FilterConnector) Match(connector *vanusv1alpha1.Connector) bool {
+	if !matchAny(connector.Spec.Kind, f.Kind, f.Kinds) || !matchAny(connector.Spec.Type, f.Type, f.Types) {
+		return false
+	}
+	if len(f.Names) > 0 {
+		matched := false
+		for _, pattern := range f.Names {
+			if ok, _ := path.Match(pattern, connector.Name); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return f.Predicate == nil || f.Predicate(connector)
+}
+
+func matchAny(value, single string, multiple []string) bool {
+	if single == "" && len(multiple) == 0 {
+		return true
+	}
+	if single != "" && value == single {
+		return true
+	}
+	for _, v := range multiple {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// filteredLister hides the connectors which are not selected by the filter.
+type filteredLister struct {
+	lister vanuslister.ConnectorLister
+	filter FilterConnector
+}
+
+func (l filteredLister) List(selector labels.Selector) ([]*vanusv1alpha1.Connector, error) {
+	connectors, err := l.lister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	ret := connectors[:0]
+	for _, connector := range connectors {
+		if l.filter.Match(connector) {
+			ret = append(ret, connector)
+		}
+	}
+	return ret, nil
+}
+
+func (l filteredLister) Get(name string) (*vanusv1alpha1.Connector, error) {
+	connector, err := l.lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !l.filter.Match(connector) {
+		return nil, k8serrors.NewNotFound(vanusv1alpha1.Resource("connectors"), name)
+	}
+	return connector, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+)
+
+func TestFilterConnectorMatch(t *testing.T) {
+	chatgpt := &vanusv1alpha1.Connector{
+		ObjectMeta: metav1.ObjectMeta{Name: "chatgpt-source"},
+		Spec:       vanusv1alpha1.ConnectorSpec{Kind: "source", Type: "chatgpt"},
+	}
+	empty := &vanusv1alpha1.Connector{}
+	isSource := func(connector *vanusv1alpha1.Connector) bool { return connector.Spec.Kind == "source" }
+
+	tests := []struct {
+		name      string
+		filter    runtime.FilterConnector
+		connector *vanusv1alpha1.Connector
+		want      bool
+	}{
+		{name: "zero value", connector: chatgpt, want: true},
+		{name: "zero value empty fields", connector: empty, want: true},
+		{name: "kind", filter: runtime.FilterConnector{Kind: "source"}, connector: chatgpt, want: true},
+		{name: "other kind", filter: runtime.FilterConnector{Kind: "sink"}, connector: chatgpt},
+		{name: "kinds", filter: runtime.FilterConnector{Kinds: []string{"sink", "source"}}, connector: chatgpt, want: true},
+		{name: "kind merged into kinds", filter: runtime.FilterConnector{Kind: "sink", Kinds: []string{"source"}}, connector: chatgpt, want: true},
+		{name: "other kinds", filter: runtime.FilterConnector{Kinds: []string{"sink"}}, connector: chatgpt},
+		{name: "type", filter: runtime.FilterConnector{Type: "chatgpt"}, connector: chatgpt, want: true},
+		{name: "types", filter: runtime.FilterConnector{Types: []string{"http", "chatgpt"}}, connector: chatgpt, want: true},
+		{name: "other types", filter: runtime.FilterConnector{Types: []string{"http"}}, connector: chatgpt},
+		{name: "kind and other type", filter: runtime.FilterConnector{Kind: "source", Type: "http"}, connector: chatgpt},
+		{name: "name glob", filter: runtime.FilterConnector{Names: []string{"chatgpt-*"}}, connector: chatgpt, want: true},
+		{name: "any name glob", filter: runtime.FilterConnector{Names: []string{"http-*", "*-source"}}, connector: chatgpt, want: true},
+		{name: "other name glob", filter: runtime.FilterConnector{Names: []string{"http-*"}}, connector: chatgpt},
+		{name: "predicate", filter: runtime.FilterConnector{Predicate: isSource}, connector: chatgpt, want: true},
+		{name: "predicate rejects", filter: runtime.FilterConnector{Predicate: isSource}, connector: empty},
+		{name: "predicate and other type", filter: runtime.FilterConnector{Type: "http", Predicate: isSource}, connector: chatgpt},
+		{name: "kinds empty kind", filter: runtime.FilterConnector{Kinds: []string{"source"}}, connector: empty},
+		{name: "types empty type", filter: runtime.FilterConnector{Types: []string{"chatgpt"}}, connector: empty},
+		{name: "kinds and types empty fields", filter: runtime.FilterConnector{Kinds: []string{"source"}, Types: []string{"chatgpt"}}, connector: empty},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.connector); got != tt.want {
+				t.Fatalf("Match() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+	log "k8s.io/klog/v2"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+)
+
+// DefaultFinalizer is the finalizer added to connectors when WithFinalizer is given an empty name.
+const DefaultFinalizer = "vanus.ai/connect-runtime"
+
+// finalizeConnector stops a connector marked for deletion and releases it by removing the
+// finalizer, the finalizer is kept until the handler succeeds so the deletion is retried.
+func (r *runtime) finalizeConnector(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+	if !hasFinalizer(connector, r.finalizer) {
+		return nil
+	}
+	err := r.updateStatus(ctx, connector.Name, func(status *vanusv1alpha1.ConnectorStatus) {
+		setPhase(status, vanusv1alpha1.ConnectorDeleting)
+	})
+	if err != nil {
+		log.Errorf("update status of connector %s failed: %+v", connector.Name, err)
+	}
+	if err = r.handleDeleteConnector(ctx, connector); err != nil {
+		return err
+	}
+	return r.updateFinalizers(ctx, connector.Name, func(connector *vanusv1alpha1.Connector) bool {
+		return removeFinalizer(connector, r.finalizer)
+	})
+}
+
+// releaseFinalizer removes the finalizer from a deleted connector which still exists but is
+// no longer selected, e.g. relabeled out of the filter, so the runtime doesn't block its
+// deletion. The finalizer is kept on the connectors owned by another runtime.
+func (r *runtime) releaseFinalizer(ctx context.Context, key string) error {
+	if r.finalizer == "" {
+		return nil
+	}
+	if _, err := r.lister().Get(key); !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return r.updateFinalizers(ctx, key, func(connector *vanusv1alpha1.Connector) bool {
+		return removeFinalizer(connector, r.finalizer)
+	})
+}
+
+// ensureFinalizer adds the finalizer to the connector if it's missing.
+func (r *runtime) ensureFinalizer(ctx context.Context, key string) error {
+	return r.updateFinalizers(ctx, key, func(connector *vanusv1alpha1.Connector) bool {
+		if connector.DeletionTimestamp != nil || hasFinalizer(connector, r.finalizer) {
+			return false
+		}
+		connector.Finalizers = append(connector.Finalizers, r.finalizer)
+		return true
+	})
+}
+
+func (r *runtime) updateFinalizers(ctx context.Context, key string, mutate func(connector *vanusv1alpha1.Connector) bool) error {
+	first := true
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var connector *vanusv1alpha1.Connector
+		var err error
+		if first {
+			first = false
+			// the connectors not selected are only got from the backend
+			if connector, err = r.lister().Get(key); k8serrors.IsNotFound(err) {
+				connector, err = r.currentStore().Get(ctx, key)
+			}
+		} else {
+			connector, err = r.currentStore().Get(ctx, key)
+		}
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		newConnector := connector.DeepCopy()
+		if !mutate(newConnector) {
+			return nil
+		}
+		_, err = r.currentStore().Update(ctx, newConnector)
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func hasFinalizer(connector *vanusv1alpha1.Connector, finalizer string) bool {
+	for _, f := range connector.Finalizers {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(connector *vanusv1alpha1.Connector, finalizer string) bool {
+	finalizers := make([]string, 0, len(connector.Finalizers))
+	for _, f := range connector.Finalizers {
+		if f != finalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	if len(finalizers) == len(connector.Finalizers) {
+		return false
+	}
+	connector.Finalizers = finalizers
+	return true
+}
@@ -0,0 +1,91 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+func newConnector(name string, labels map[string]string) *vanusv1alpha1.Connector {
+	return &vanusv1alpha1.Connector{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec:       vanusv1alpha1.ConnectorSpec{Kind: "source", Type: "chatgpt"},
+	}
+}
+
+func TestFinalizerRemovedWhenFilteredOut(t *testing.T) {
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{},
+		runtime.WithFinalizer(""), runtime.WithFilter("team=a"))
+
+	h.Create(newConnector("a", map[string]string{"team": "a"}))
+	h.WaitForObserved("a")
+	h.WaitForIdle()
+	if !hasFinalizer(h.Get("a")) {
+		t.Fatal("finalizer is not added")
+	}
+
+	if err := h.Runtime().SetFilter(context.Background(), "team=b"); err != nil {
+		t.Fatalf("failed to set filter: %v", err)
+	}
+	h.WaitForEvents(2)
+	h.WaitForIdle()
+	h.ExpectEvents(
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a"},
+		runtimetest.Event{Type: runtimetest.EventDelete, ConnectorID: "a"},
+	)
+	if hasFinalizer(h.Get("a")) {
+		t.Fatal("finalizer is kept on a connector no longer selected")
+	}
+
+	// nothing blocks the deletion any more
+	h.Delete("a")
+	if connector := h.Get("a"); connector != nil {
+		t.Fatalf("connector is stuck deleting: %+v", connector)
+	}
+}
+
+func TestFinalizerRemovedWhenRelabeled(t *testing.T) {
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{},
+		runtime.WithFinalizer(""), runtime.WithFilter("team=a"))
+
+	h.Create(newConnector("a", map[string]string{"team": "a"}))
+	h.WaitForObserved("a")
+	h.WaitForIdle()
+
+	connector := h.Get("a")
+	connector.Labels["team"] = "b"
+	h.Update(connector)
+	h.WaitForEvents(2)
+	h.WaitForIdle()
+	if hasFinalizer(h.Get("a")) {
+		t.Fatal("finalizer is kept on a connector no longer selected")
+	}
+}
+
+func hasFinalizer(connector *vanusv1alpha1.Connector) bool {
+	for _, finalizer := range connector.Finalizers {
+		if finalizer == runtime.DefaultFinalizer {
+			return true
+		}
+	}
+	return false
+}
@@ -14,10 +14,12 @@
 
 package runtime
 
-type FilterConnector struct {
-	Kind string
-	Type string
-}
+import (
+	"context"
+	"time"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+)
 
 type ConnectorEventHandler interface {
 	OnAdd(connectorID, config string) error
@@ -54,3 +56,126 @@ func (r ConnectorEventHandlerFuncs) OnDelete(connectorID string) error {
 	}
 	return nil
 }
+
+// ConnectorHandler is the context aware successor of ConnectorEventHandler, it is given a deep
+// copy of the whole connector instead of its name and config. The context is cancelled when
+// the runtime is shutting down.
+type ConnectorHandler interface {
+	OnAdd(ctx context.Context, connector *vanusv1alpha1.Connector) error
+	OnUpdate(ctx context.Context, old, new *vanusv1alpha1.Connector) error
+	OnDelete(ctx context.Context, connector *vanusv1alpha1.Connector) error
+}
+
+type ConnectorHandlerFuncs struct {
+	AddFunc    func(ctx context.Context, connector *vanusv1alpha1.Connector) error
+	UpdateFunc func(ctx context.Context, old, new *vanusv1alpha1.Connector) error
+	DeleteFunc func(ctx context.Context, connector *vanusv1alpha1.Connector) error
+}
+
+// OnAdd calls AddFunc if it's not nil.
+func (r ConnectorHandlerFuncs) OnAdd(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+	if r.AddFunc != nil {
+		return r.AddFunc(ctx, connector)
+	}
+	return nil
+}
+
+// OnUpdate calls UpdateFunc if it's not nil.
+func (r ConnectorHandlerFuncs) OnUpdate(ctx context.Context, old, new *vanusv1alpha1.Connector) error {
+	if r.UpdateFunc != nil {
+		return r.UpdateFunc(ctx, old, new)
+	}
+	return nil
+}
+
+// OnDelete calls DeleteFunc if it's not nil.
+func (r ConnectorHandlerFuncs) OnDelete(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+	if r.DeleteFunc != nil {
+		return r.DeleteFunc(ctx, connector)
+	}
+	return nil
+}
+
+// ActiveConnectorLister is implemented by handlers which know the connectors they are running.
+// The runtime asks for them at startup and deletes those which no longer exist, so connectors
+// deleted while the runtime was down or missing watch events don't keep running as orphans.
+type ActiveConnectorLister interface {
+	ActiveConnectors(ctx context.Context) ([]string, error)
+}
+
+// ConnectorStopper is implemented by handlers which can stop a running connector without
+// deleting it, the runtime stops all the running connectors during a graceful shutdown.
+type ConnectorStopper interface {
+	OnStop(ctx context.Context, connectorID string) error
+}
+
+// AdaptEventHandler adapts a ConnectorEventHandler to ConnectorHandler, the optional
+// interfaces implemented by handler are kept.
+func AdaptEventHandler(handler ConnectorEventHandler) ConnectorHandler {
+	return eventHandlerAdapter{handler: handler}
+}
+
+// eventHandlerAdapter adapts a ConnectorEventHandler to ConnectorHandler.
+type eventHandlerAdapter struct {
+	handler ConnectorEventHandler
+}
+
+func (a eventHandlerAdapter) OnAdd(_ context.Context, connector *vanusv1alpha1.Connector) error {
+	return a.handler.OnAdd(connector.Name, connector.Spec.Config)
+}
+
+func (a eventHandlerAdapter) OnUpdate(_ context.Context, _, new *vanusv1alpha1.Connector) error {
+	return a.handler.OnUpdate(new.Name, new.Spec.Config)
+}
+
+func (a eventHandlerAdapter) OnDelete(_ context.Context, connector *vanusv1alpha1.Connector) error {
+	return a.handler.OnDelete(connector.Name)
+}
+
+// InjectStatusReporter injects the reporter into the adapted handler if it wants one.
+func (a eventHandlerAdapter) InjectStatusReporter(reporter StatusReporter) {
+	if injector, ok := a.handler.(StatusReporterInjector); ok {
+		injector.InjectStatusReporter(reporter)
+	}
+}
+
+// ActiveConnectors lists the connectors of the adapted handler if it knows them.
+func (a eventHandlerAdapter) ActiveConnectors(ctx context.Context) ([]string, error) {
+	if activeLister, ok := a.handler.(ActiveConnectorLister); ok {
+		return activeLister.ActiveConnectors(ctx)
+	}
+	return nil, nil
+}
+
+// OnStop stops the connector of the adapted handler if it supports it.
+func (a eventHandlerAdapter) OnStop(ctx context.Context, connectorID string) error {
+	if stopper, ok := a.handler.(ConnectorStopper); ok {
+		return stopper.OnStop(ctx, connectorID)
+	}
+	return nil
+}
+
+// Result is the result of a Reconcile invocation.
+type Result struct {
+	// Requeue tells the runtime to reconcile the connector again with rate limiting.
+	Requeue bool
+	// RequeueAfter tells the runtime to reconcile the connector again after the duration,
+	// it takes precedence over Requeue.
+	RequeueAfter time.Duration
+}
+
+// Reconciler is the level-triggered alternative of ConnectorEventHandler, instead of being told
+// what happened it is given the current state of a connector and drives the world towards it.
+type Reconciler interface {
+	// Reconcile is called whenever the connector changed or is requeued, connector is a deep
+	// copy of the current state, or nil if the connector has been deleted.
+	Reconcile(ctx context.Context, connectorID string, connector *vanusv1alpha1.Connector) (Result, error)
+}
+
+// ReconcilerFunc is an adapter to allow the use of ordinary functions as Reconciler.
+type ReconcilerFunc func(ctx context.Context, connectorID string, connector *vanusv1alpha1.Connector) (Result, error)
+
+// Reconcile calls f(ctx, connectorID, connector).
+func (f ReconcilerFunc) Reconcile(ctx context.Context, connectorID string, connector *vanusv1alpha1.Connector) (Result, error) {
+	return f(ctx, connectorID, connector)
+}
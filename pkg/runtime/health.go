@@ -0,0 +1,142 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Checker checks the health of a component, a non-nil error means unhealthy.
+type Checker func(req *http.Request) error
+
+// WaitForReady blocks until the caches of runtime have synced and the workers are started,
+// or ctx is done. The error of Run is returned if the runtime failed to start.
+func (r *runtime) WaitForReady(ctx context.Context) error {
+	select {
+	case <-r.readyCh:
+		return r.startErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *runtime) markReady() {
+	r.readyOnce.Do(func() {
+		close(r.readyCh)
+	})
+}
+
+// markFailed records the error the runtime failed to start with and unblocks WaitForReady.
+func (r *runtime) markFailed(err error) {
+	r.readyOnce.Do(func() {
+		r.startErr = err
+		close(r.readyCh)
+	})
+}
+
+func (r *runtime) ready() bool {
+	select {
+	case <-r.readyCh:
+		return r.startErr == nil
+	default:
+		return false
+	}
+}
+
+// healthzChecks returns the liveness checks of runtime along with the ones added by options.
+func (r *runtime) healthzChecks() map[string]Checker {
+	checks := map[string]Checker{
+		"store": func(_ *http.Request) error {
+			if r.ready() && !r.currentStore().HasSynced() {
+				return errors.New("store is not synced")
+			}
+			return nil
+		},
+		"workers": func(_ *http.Request) error {
+			// a standby replica of leader election runs no worker
+			if r.ready() && r.leaderElection == nil && r.activeWorkers.Load() == 0 {
+				return errors.New("no worker is running")
+			}
+			return nil
+		},
+	}
+	for name, check := range r.healthzExtraChecks {
+		checks[name] = check
+	}
+	return checks
+}
+
+// readyzChecks returns the readiness checks of runtime along with the ones added by options.
+func (r *runtime) readyzChecks() map[string]Checker {
+	checks := map[string]Checker{
+		"runtime": func(_ *http.Request) error {
+			if !r.ready() {
+				return errors.New("runtime is not ready")
+			}
+			return nil
+		},
+	}
+	for name, check := range r.readyzExtraChecks {
+		checks[name] = check
+	}
+	return checks
+}
+
+// serveHealthProbes serves /healthz and /readyz on addr until ctx is done.
+func (r *runtime) serveHealthProbes(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", checkHandler(r.healthzChecks()))
+	mux.Handle("/readyz", checkHandler(r.readyzChecks()))
+	serve(ctx, "health probes", addr, mux)
+}
+
+// checkHandler runs all the checks, it responds 200 if all of them pass or 500 otherwise,
+// the result of every check is listed with the verbose query parameter.
+func checkHandler(checks map[string]Checker) http.Handler {
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var output strings.Builder
+		failed := false
+		for _, name := range names {
+			if err := checks[name](req); err != nil {
+				failed = true
+				fmt.Fprintf(&output, "[-]%s failed: %v\n", name, err)
+			} else {
+				fmt.Fprintf(&output, "[+]%s ok\n", name)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if failed {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = fmt.Fprint(w, output.String())
+			return
+		}
+		if _, verbose := req.URL.Query()["verbose"]; verbose {
+			_, _ = fmt.Fprint(w, output.String())
+		}
+		_, _ = fmt.Fprint(w, "ok")
+	})
+}
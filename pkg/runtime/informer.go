@@ -0,0 +1,108 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	clientset "github.com/vanus-labs/vanus-connect-runtime/pkg/client/clientset/versioned"
+	vanusinformer "github.com/vanus-labs/vanus-connect-runtime/pkg/client/informers/externalversions"
+	vanuslister "github.com/vanus-labs/vanus-connect-runtime/pkg/client/listers/vanus/v1alpha1"
+)
+
+// informerStore is the Store watching the connector resource of Kubernetes by an informer.
+type informerStore struct {
+	client   clientset.Interface
+	selector string
+	factory  vanusinformer.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	lister   vanuslister.ConnectorLister
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewInformerStore returns a Store watching the connectors matching the label selector.
+func NewInformerStore(client clientset.Interface, selector string) Store {
+	factory := vanusinformer.NewSharedInformerFactoryWithOptions(client, 0,
+		vanusinformer.WithTweakListOptions(func(listOption *metav1.ListOptions) {
+			listOption.AllowWatchBookmarks = true
+			listOption.LabelSelector = selector
+		}))
+
+	informer := factory.Vanus().V1alpha1().Connectors()
+	return &informerStore{
+		client:   client,
+		selector: selector,
+		factory:  factory,
+		informer: informer.Informer(),
+		lister:   informer.Lister(),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+func (s *informerStore) AddEventHandler(handler cache.ResourceEventHandler) error {
+	_, err := s.informer.AddEventHandler(handler)
+	return err
+}
+
+func (s *informerStore) Start(ctx context.Context) error {
+	// fail fast if the API server is unreachable or the connector resource is unavailable
+	_, err := s.client.VanusV1alpha1().Connectors().List(ctx, metav1.ListOptions{
+		LabelSelector: s.selector,
+		Limit:         1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list connectors: %w", err)
+	}
+	s.factory.Start(s.stopCh)
+	return nil
+}
+
+func (s *informerStore) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+		s.factory.Shutdown()
+	})
+}
+
+func (s *informerStore) HasSynced() bool {
+	return s.informer.HasSynced()
+}
+
+func (s *informerStore) Lister() vanuslister.ConnectorLister {
+	return s.lister
+}
+
+func (s *informerStore) Get(ctx context.Context, name string) (*vanusv1alpha1.Connector, error) {
+	return s.client.VanusV1alpha1().Connectors().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (s *informerStore) Update(ctx context.Context, connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error) {
+	return s.client.VanusV1alpha1().Connectors().Update(ctx, connector, metav1.UpdateOptions{})
+}
+
+func (s *informerStore) UpdateStatus(ctx context.Context, connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error) {
+	return s.client.VanusV1alpha1().Connectors().UpdateStatus(ctx, connector, metav1.UpdateOptions{})
+}
+
+func (s *informerStore) WithFilter(filter string) (Store, error) {
+	return NewInformerStore(s.client, filter), nil
+}
@@ -0,0 +1,251 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	defaultRenewDeadline = 10 * time.Second
+	defaultRetryPeriod   = 2 * time.Second
+)
+
+type leaderElectionOptions struct {
+	leaseName     string
+	namespace     string
+	leaseDuration time.Duration
+	renewDeadline time.Duration
+	retryPeriod   time.Duration
+}
+
+// identity returns an identity unique among the replicas of runtime.
+func identity() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return hostname + "_" + string(uuid.NewUUID())
+}
+
+// runLeaderElection campaigns for the lease until ctx is done, the connectors are only handled
+// while the runtime is the leader.
+func (r *runtime) runLeaderElection(ctx, handlerCtx context.Context) {
+	renewal := newRenewalState()
+	lock := &renewalObservedLock{
+		Interface: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      r.leaderElection.leaseName,
+				Namespace: r.leaderElection.namespace,
+			},
+			Client: r.kubeClient.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: r.identity,
+			},
+		},
+		renewal: renewal,
+	}
+	for ctx.Err() == nil {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   r.leaderElection.leaseDuration,
+			RenewDeadline:   r.leaderElection.renewDeadline,
+			RetryPeriod:     r.leaderElection.retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            r.leaderElection.leaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(leaderCtx context.Context) {
+					r.goWorker(func() { r.lead(ctx, handlerCtx, leaderCtx, renewal) })
+				},
+				OnStoppedLeading: func() {
+					log.Infof("%s stopped leading", r.identity)
+				},
+				OnNewLeader: func(identity string) {
+					log.Infof("new leader elected: %s", identity)
+				},
+			},
+		})
+	}
+}
+
+// lead handles the connectors until leaderCtx is done. Once renewing the lease fails, the
+// workers are stopped and all the connectors are released right away, so they are not running
+// twice if another replica takes over, and they are added again if the lease is renewed before
+// it's lost.
+func (r *runtime) lead(ctx, handlerCtx, leaderCtx context.Context, renewal *renewalState) {
+	log.Infof("%s started leading", r.identity)
+	// the runtime knows nothing about what the previous leader applied, replay all the
+	// connectors so they are added again
+	if err := r.enqueueAllConnectors(); err != nil {
+		log.Errorf("failed to list connectors: %+v", err)
+	}
+	if err := r.enqueueOrphanConnectors(leaderCtx); err != nil {
+		log.Errorf("failed to list active connectors of handler: %+v", err)
+	}
+	for {
+		workersCtx, stopWorkers := context.WithCancel(leaderCtx)
+		handlersCtx, cancelHandlers := context.WithCancel(handlerCtx)
+		r.startConnectorWorkers(workersCtx, handlersCtx)
+		failing := renewal.wait(leaderCtx, true)
+		stopWorkers()
+		if ctx.Err() != nil {
+			// the runtime is shutting down, the in-flight handler invocations are drained
+			// until handlerCtx is done
+			go func() {
+				<-handlerCtx.Done()
+				cancelHandlers()
+			}()
+			return
+		}
+		// the in-flight handler invocations are canceled so the connectors are released
+		// right away
+		cancelHandlers()
+		if failing {
+			log.Warningf("%s failed to renew the leader lease, releasing all connectors", r.identity)
+		}
+		r.releaseAllConnectors(ctx)
+		if !failing || !renewal.wait(leaderCtx, false) {
+			return
+		}
+		log.Infof("%s renewed the leader lease again", r.identity)
+		if err := r.enqueueAllConnectors(); err != nil {
+			log.Errorf("failed to list connectors: %+v", err)
+		}
+	}
+}
+
+// renewalState tracks whether renewing the leader lease is failing.
+type renewalState struct {
+	mu      sync.Mutex
+	failing bool
+	// changed is closed and replaced once failing changed
+	changed chan struct{}
+}
+
+func newRenewalState() *renewalState {
+	return &renewalState{changed: make(chan struct{})}
+}
+
+func (s *renewalState) set(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing == failing {
+		return
+	}
+	s.failing = failing
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// wait waits until failing is the given state, it returns false if ctx is done before.
+func (s *renewalState) wait(ctx context.Context, failing bool) bool {
+	for {
+		s.mu.Lock()
+		current, changed := s.failing, s.changed
+		s.mu.Unlock()
+		if current == failing {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// renewalObservedLock records whether the last attempt of leader election to get and update
+// the lock failed, the leader keeps retrying until the renew deadline before giving up.
+type renewalObservedLock struct {
+	resourcelock.Interface
+	renewal *renewalState
+}
+
+func (l *renewalObservedLock) Get(ctx context.Context) (*resourcelock.LeaderElectionRecord, []byte, error) {
+	record, raw, err := l.Interface.Get(ctx)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		l.renewal.set(true)
+	}
+	return record, raw, err
+}
+
+func (l *renewalObservedLock) Create(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	err := l.Interface.Create(ctx, ler)
+	l.renewal.set(err != nil)
+	return err
+}
+
+func (l *renewalObservedLock) Update(ctx context.Context, ler resourcelock.LeaderElectionRecord) error {
+	err := l.Interface.Update(ctx, ler)
+	l.renewal.set(err != nil)
+	return err
+}
+
+// releaseAllConnectors stops all the connectors applied to the handler without touching them
+// in the cluster, they are taken over by another replica.
+func (r *runtime) releaseAllConnectors(ctx context.Context) {
+	// wait for the in-flight handler invocations
+	r.syncLock.Lock()
+	defer r.syncLock.Unlock()
+
+	r.appliedLock.RLock()
+	applied := make([]string, 0, len(r.applied))
+	for key := range r.applied {
+		applied = append(applied, key)
+	}
+	r.appliedLock.RUnlock()
+	for _, key := range applied {
+		if err := r.releaseConnector(ctx, key); err != nil {
+			log.Errorf("release connector %s failed: %+v", key, err)
+		}
+	}
+}
+
+// releaseConnector stops the connector in the handler only.
+func (r *runtime) releaseConnector(ctx context.Context, key string) error {
+	applied := r.getApplied(key)
+	if applied == nil {
+		return nil
+	}
+	log.Infof("release connector %s", key)
+	var err error
+	if r.reconciler != nil {
+		err = observeHandler(operationReconcile, applied, func() error {
+			_, err := r.reconciler.Reconcile(ctx, key, nil)
+			return err
+		})
+	} else {
+		err = observeHandler(operationDelete, applied, func() error {
+			return r.handler.OnDelete(ctx, applied.DeepCopy())
+		})
+	}
+	if err != nil {
+		return err
+	}
+	r.deleteApplied(key)
+	r.forgetConnector(key)
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+func TestLeaderReleasesConnectorsOnRenewFailure(t *testing.T) {
+	kube := kubefake.NewSimpleClientset()
+	var failing atomic.Bool
+	kube.PrependReactor("update", "leases", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		if failing.Load() {
+			return true, nil, errors.New("apiserver unavailable")
+		}
+		return false, nil, nil
+	})
+	// b blocks the first time until it's canceled
+	var blocked atomic.Bool
+	started := make(chan struct{})
+	handler := runtime.ConnectorHandlerFuncs{
+		AddFunc: func(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+			if connector.Name != "b" || blocked.Swap(true) {
+				return nil
+			}
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	}
+	// the connectors must be released long before the lease is lost
+	h := runtimetest.New(t, handler,
+		runtime.WithKubeClient(kube),
+		runtime.WithLeaderElection("leader", "default"),
+		runtime.WithLeaderElectionPeriods(time.Minute, 30*time.Second, 50*time.Millisecond))
+
+	h.Create(newConnector("a", nil))
+	h.WaitForEvents(1)
+	h.Create(newConnector("b", nil))
+	<-started
+
+	failing.Store(true)
+	h.WaitForEvents(3)
+	h.ExpectEvents(
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a"},
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "b", Err: context.Canceled},
+		runtimetest.Event{Type: runtimetest.EventDelete, ConnectorID: "a"},
+	)
+
+	// the connectors are added again once the lease is renewed
+	h.ResetEvents()
+	failing.Store(false)
+	events := h.WaitForEvents(2)
+	added := map[string]bool{}
+	for _, event := range events {
+		if event.Type != runtimetest.EventAdd || event.Err != nil {
+			t.Fatalf("unexpected event %s", event)
+		}
+		added[event.ConnectorID] = true
+	}
+	if !added["a"] || !added["b"] {
+		t.Fatalf("connectors are not added again: %v", events)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/util/workqueue"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	// connectorLeasePrefix is the name prefix of the ownership lease of connectors.
+	connectorLeasePrefix = "connector-"
+	// maxConcurrentRenews is the number of leases renewed concurrently.
+	maxConcurrentRenews = 16
+)
+
+// connectorLeases holds an ownership lease per connector, a connector is only run by the
+// runtime holding its lease. The leases are renewed periodically, a lease which could not be
+// renewed within the renew deadline is considered lost and its connector is stopped, before
+// the lease expires and another runtime can acquire it.
+type connectorLeases struct {
+	r         *runtime
+	namespace string
+	clock     func() time.Time
+	duration  time.Duration
+	deadline  time.Duration
+	period    time.Duration
+
+	mu sync.Mutex
+	// held is the leases held, keyed by connector key
+	held map[string]*heldLease
+}
+
+type heldLease struct {
+	// renewed is the last successful renew time, it's zero if the lease is taken over
+	renewed time.Time
+	// lease is the lease last written, it's renewed without reading it again
+	lease *coordinationv1.Lease
+}
+
+func newConnectorLeases(r *runtime, namespace string, period time.Duration) *connectorLeases {
+	return &connectorLeases{
+		r:         r,
+		namespace: namespace,
+		clock:     r.clock.Now,
+		duration:  defaultLeaseDuration,
+		deadline:  defaultRenewDeadline,
+		period:    period,
+		held:      map[string]*heldLease{},
+	}
+}
+
+// lost returns true if the lease of connector is held but could not be renewed in time.
+func (l *connectorLeases) lost(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	held, ok := l.held[key]
+	return ok && l.clock().Sub(held.renewed) > l.deadline
+}
+
+// acquire tries to acquire the lease of connector, it returns false if the lease is held by
+// another runtime.
+func (l *connectorLeases) acquire(ctx context.Context, key string) (bool, error) {
+	l.mu.Lock()
+	_, ok := l.held[key]
+	l.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+
+	now := metav1.NewMicroTime(l.clock())
+	durationSeconds := int32(l.duration.Seconds())
+	lease, err := l.leases().Get(ctx, connectorLeasePrefix+key, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      connectorLeasePrefix + key,
+				Namespace: l.namespace,
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.r.identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if lease, err = l.leases().Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			if k8serrors.IsAlreadyExists(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		l.markHeld(key, lease)
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != "" && *holder != l.r.identity &&
+		!leaseExpired(lease, now.Time) {
+		return false, nil
+	}
+	lease.Spec.HolderIdentity = &l.r.identity
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	// the update fails with conflict if another runtime acquired it in the meantime
+	if lease, err = l.leases().Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		if k8serrors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	log.Infof("acquired lease of connector %s", key)
+	l.markHeld(key, lease)
+	return true, nil
+}
+
+// release gives up the lease of connector if it's held, so another runtime can acquire it
+// without waiting for it to expire.
+func (l *connectorLeases) release(ctx context.Context, key string) {
+	l.mu.Lock()
+	held, ok := l.held[key]
+	delete(l.held, key)
+	l.mu.Unlock()
+	if !ok || l.clock().Sub(held.renewed) > l.deadline {
+		return
+	}
+
+	lease, err := l.leases().Get(ctx, connectorLeasePrefix+key, metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			log.Errorf("release lease of connector %s failed: %+v", key, err)
+		}
+		return
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.r.identity {
+		return
+	}
+	lease.Spec.HolderIdentity = nil
+	if _, err = l.leases().Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		log.Errorf("release lease of connector %s failed: %+v", key, err)
+		return
+	}
+	log.Infof("released lease of connector %s", key)
+}
+
+// remove deletes the lease of a deleted connector unless it's held by another runtime.
+func (l *connectorLeases) remove(ctx context.Context, key string) {
+	l.mu.Lock()
+	delete(l.held, key)
+	l.mu.Unlock()
+
+	lease, err := l.leases().Get(ctx, connectorLeasePrefix+key, metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			log.Errorf("delete lease of connector %s failed: %+v", key, err)
+		}
+		return
+	}
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != "" && *holder != l.r.identity &&
+		!leaseExpired(lease, l.clock()) {
+		return
+	}
+	// the lease is kept if another runtime acquired it in the meantime
+	err = l.leases().Delete(ctx, lease.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !k8serrors.IsNotFound(err) && !k8serrors.IsConflict(err) {
+		log.Errorf("delete lease of connector %s failed: %+v", key, err)
+		return
+	}
+	log.Infof("deleted lease of connector %s", key)
+}
+
+func (l *connectorLeases) run(ctx context.Context) {
+	if l.period <= 0 {
+		// the leases are only renewed on demand, e.g. in tests
+		return
+	}
+	wait.UntilWithContext(ctx, l.renewAll, l.period)
+}
+
+// renewAll renews all the leases held concurrently, and enqueues the connectors whose lease
+// is lost so they are stopped.
+func (l *connectorLeases) renewAll(ctx context.Context) {
+	l.mu.Lock()
+	keys := make([]string, 0, len(l.held))
+	for key := range l.held {
+		keys = append(keys, key)
+	}
+	l.mu.Unlock()
+
+	workqueue.ParallelizeUntil(ctx, maxConcurrentRenews, len(keys), func(i int) {
+		key := keys[i]
+		if err := l.renew(ctx, key); err != nil {
+			log.Errorf("renew lease of connector %s failed: %+v", key, err)
+		}
+		if l.lost(key) {
+			l.r.connectorQueue.Add(key)
+		}
+	})
+}
+
+// renew renews the lease last written, it's only read again if it has been changed since.
+func (l *connectorLeases) renew(ctx context.Context, key string) error {
+	l.mu.Lock()
+	held, ok := l.held[key]
+	l.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	now := metav1.NewMicroTime(l.clock())
+	lease := held.lease.DeepCopy()
+	lease.Spec.RenewTime = &now
+	renewed, err := l.leases().Update(ctx, lease, metav1.UpdateOptions{})
+	if k8serrors.IsConflict(err) || k8serrors.IsNotFound(err) {
+		if lease, err = l.leases().Get(ctx, connectorLeasePrefix+key, metav1.GetOptions{}); err != nil {
+			if k8serrors.IsNotFound(err) {
+				l.markLost(key)
+				return nil
+			}
+			return err
+		}
+		if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != l.r.identity {
+			// taken over by another runtime
+			l.markLost(key)
+			return nil
+		}
+		lease.Spec.RenewTime = &now
+		renewed, err = l.leases().Update(ctx, lease, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+	l.markRenewed(key, renewed)
+	return nil
+}
+
+// markHeld records the lease acquired.
+func (l *connectorLeases) markHeld(key string, lease *coordinationv1.Lease) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held[key] = &heldLease{renewed: lease.Spec.RenewTime.Time, lease: lease}
+}
+
+// markRenewed records the lease renewed unless it has been released in the meantime.
+func (l *connectorLeases) markRenewed(key string, lease *coordinationv1.Lease) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.held[key]; ok {
+		l.held[key] = &heldLease{renewed: lease.Spec.RenewTime.Time, lease: lease}
+	}
+}
+
+// markLost marks the lease as lost so its connector is stopped.
+func (l *connectorLeases) markLost(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if held, ok := l.held[key]; ok {
+		held.renewed = time.Time{}
+	}
+}
+
+func (l *connectorLeases) leases() coordinationv1client.LeaseInterface {
+	return l.r.kubeClient.CoordinationV1().Leases(l.namespace)
+}
+
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return !now.Before(lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second))
+}
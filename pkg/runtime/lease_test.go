@@ -0,0 +1,160 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+func getLease(t *testing.T, kube *kubefake.Clientset, name string) error {
+	t.Helper()
+	_, err := kube.CoordinationV1().Leases("default").Get(context.Background(), "connector-"+name, metav1.GetOptions{})
+	return err
+}
+
+func TestConnectorLeaseDeleted(t *testing.T) {
+	for _, finalizer := range []bool{false, true} {
+		t.Run(fmt.Sprintf("finalizer=%t", finalizer), func(t *testing.T) {
+			kube := kubefake.NewSimpleClientset()
+			opts := []runtime.ConnectorOption{
+				runtime.WithKubeClient(kube),
+				runtime.WithConnectorLeases("default"),
+				runtime.WithoutPeriodicSync(),
+			}
+			if finalizer {
+				opts = append(opts, runtime.WithFinalizer(""))
+			}
+			h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{}, opts...)
+
+			h.Create(newConnector("a", nil))
+			h.WaitForObserved("a")
+			h.WaitForIdle()
+			if err := getLease(t, kube, "a"); err != nil {
+				t.Fatalf("failed to get lease: %v", err)
+			}
+
+			h.Delete("a")
+			h.WaitForObserved("a")
+			h.WaitForIdle()
+			if h.Get("a") != nil {
+				t.Fatal("connector is not deleted")
+			}
+			if err := getLease(t, kube, "a"); !k8serrors.IsNotFound(err) {
+				t.Fatalf("lease of deleted connector is kept: %v", err)
+			}
+		})
+	}
+}
+
+// barrierLeases makes lease updates wait for each other, they only complete in time if they
+// run concurrently.
+type barrierLeases struct {
+	coordinationv1client.LeaseInterface
+	barrier *barrier
+}
+
+type barrier struct {
+	n       int32
+	arrived atomic.Int32
+	done    chan struct{}
+	timeout atomic.Bool
+}
+
+func (l barrierLeases) Update(ctx context.Context, lease *coordinationv1.Lease, opts metav1.UpdateOptions) (*coordinationv1.Lease, error) {
+	b := l.barrier
+	if b.arrived.Add(1) == b.n {
+		close(b.done)
+	}
+	select {
+	case <-b.done:
+	case <-time.After(time.Second):
+		b.timeout.Store(true)
+	}
+	return l.LeaseInterface.Update(ctx, lease, opts)
+}
+
+type barrierCoordination struct {
+	coordinationv1client.CoordinationV1Interface
+	leases barrierLeases
+}
+
+func (c barrierCoordination) Leases(namespace string) coordinationv1client.LeaseInterface {
+	c.leases.LeaseInterface = c.CoordinationV1Interface.Leases(namespace)
+	return c.leases
+}
+
+type barrierKube struct {
+	*kubefake.Clientset
+	enabled *atomic.Bool
+	leases  barrierLeases
+}
+
+func (k barrierKube) CoordinationV1() coordinationv1client.CoordinationV1Interface {
+	if !k.enabled.Load() {
+		return k.Clientset.CoordinationV1()
+	}
+	return barrierCoordination{CoordinationV1Interface: k.Clientset.CoordinationV1(), leases: k.leases}
+}
+
+func TestConnectorLeasesRenewedConcurrently(t *testing.T) {
+	const n = 4
+	b := &barrier{n: n, done: make(chan struct{})}
+	kube := barrierKube{
+		Clientset: kubefake.NewSimpleClientset(),
+		enabled:   &atomic.Bool{},
+		leases:    barrierLeases{barrier: b},
+	}
+	var gets atomic.Int32
+	kube.PrependReactor("get", "leases", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		if kube.enabled.Load() {
+			gets.Add(1)
+		}
+		return false, nil, nil
+	})
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{},
+		runtime.WithKubeClient(kube), runtime.WithConnectorLeases("default"), runtime.WithoutPeriodicSync())
+	for i := 0; i < n; i++ {
+		h.Create(newConnector(fmt.Sprintf("c%d", i), nil))
+	}
+	for i := 0; i < n; i++ {
+		h.WaitForObserved(fmt.Sprintf("c%d", i))
+	}
+	h.WaitForIdle()
+
+	kube.enabled.Store(true)
+	runtime.RenewConnectorLeases(context.Background(), h.Runtime())
+	kube.enabled.Store(false)
+	if b.timeout.Load() {
+		t.Fatal("leases are not renewed concurrently")
+	}
+	if got := gets.Load(); got != 0 {
+		t.Fatalf("leases are read %d times to renew them", got)
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	log "k8s.io/klog/v2"
+	"k8s.io/utils/clock"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+)
+
+// ConnectorConfig is the config a connector is started with.
+type ConnectorConfig struct {
+	// ID is the name of the connector resource.
+	ID   string
+	Kind string
+	Type string
+	// Config is the config file of the connector.
+	Config string
+	// Connector is the connector resource, it must not be modified.
+	Connector *vanusv1alpha1.Connector
+}
+
+// Connector is a connector run by the Manager.
+type Connector interface {
+	// Start runs the connector until ctx is done and then returns nil. The connector is
+	// restarted with backoff if it returns an error, or returns before ctx is done.
+	Start(ctx context.Context, cfg ConnectorConfig) error
+}
+
+// ConnectorFunc is a function implementing Connector.
+type ConnectorFunc func(ctx context.Context, cfg ConnectorConfig) error
+
+// Start calls f(ctx, cfg).
+func (f ConnectorFunc) Start(ctx context.Context, cfg ConnectorConfig) error {
+	return f(ctx, cfg)
+}
+
+// Factory creates the connectors of a type, a new connector is created on every start. An
+// error wrapping ErrInvalidConfig is reported as an invalid config.
+type Factory interface {
+	New(cfg ConnectorConfig) (Connector, error)
+}
+
+// FactoryFunc is a function implementing Factory.
+type FactoryFunc func(cfg ConnectorConfig) (Connector, error)
+
+// New calls f(cfg).
+func (f FactoryFunc) New(cfg ConnectorConfig) (Connector, error) {
+	return f(cfg)
+}
+
+// DefaultRestartPolicy returns the restart policy used if WithRestartPolicy is not given.
+func DefaultRestartPolicy() RetryPolicy {
+	return RetryPolicy{
+		BaseDelay: time.Second,
+		MaxDelay:  5 * time.Minute,
+		Jitter:    0.1,
+	}
+}
+
+type ManagerOption func(opt *managerOptions)
+
+type managerOptions struct {
+	restartPolicy RetryPolicy
+	clock         clock.WithTicker
+}
+
+// WithRestartPolicy sets the backoff of restarting failed connectors, the zero fields of
+// policy are taken from DefaultRestartPolicy. The failures are counted since the last time
+// the connector ran longer than MaxDelay, the connector is marked as Failed after MaxAttempts
+// consecutive failures and no longer restarted until its spec changes.
+func WithRestartPolicy(policy RetryPolicy) ManagerOption {
+	return func(opt *managerOptions) {
+		opt.restartPolicy = policy.withDefaults(DefaultRestartPolicy())
+	}
+}
+
+// WithManagerClock sets the clock the restarts are scheduled by, it's used to fake the time
+// in tests.
+func WithManagerClock(clock clock.WithTicker) ManagerOption {
+	return func(opt *managerOptions) {
+		opt.clock = clock
+	}
+}
+
+// Manager is a ConnectorHandler running every connector in its own goroutine by the Factory
+// registered for its Spec.Type. A connector is stopped by canceling its context when it's
+// deleted, restarted when its spec changes and restarted with backoff when it fails. The
+// runtime injects its StatusReporter into the Manager, the failures are reported through it.
+type Manager struct {
+	opts managerOptions
+
+	mu         sync.Mutex
+	factories  map[string]Factory
+	connectors map[string]*managedConnector
+	reporter   StatusReporter
+}
+
+var (
+	_ ConnectorHandler       = &Manager{}
+	_ ConnectorStopper       = &Manager{}
+	_ StatusReporterInjector = &Manager{}
+)
+
+// managedConnector is a connector run by the Manager.
+type managedConnector struct {
+	cfg    ConnectorConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+	// stopping is set once the connector is asked to stop, it's guarded by Manager.mu
+	stopping bool
+}
+
+// NewManager creates a Manager without any factory registered.
+func NewManager(opts ...ManagerOption) *Manager {
+	defaultOpts := managerOptions{
+		restartPolicy: DefaultRestartPolicy(),
+		clock:         clock.RealClock{},
+	}
+	for _, apply := range opts {
+		apply(&defaultOpts)
+	}
+	return &Manager{
+		opts:       defaultOpts,
+		factories:  map[string]Factory{},
+		connectors: map[string]*managedConnector{},
+	}
+}
+
+// Register registers the factory of the connectors of type typ, it replaces the factory
+// registered before. The running connectors are not affected.
+func (m *Manager) Register(typ string, factory Factory) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.factories[typ] = factory
+}
+
+// InjectStatusReporter implements StatusReporterInjector.
+func (m *Manager) InjectStatusReporter(reporter StatusReporter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reporter = reporter
+}
+
+// OnAdd starts the connector, it's restarted if it's already running with another spec.
+func (m *Manager) OnAdd(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+	if running := m.get(connector.Name); running != nil {
+		if !m.isStopping(running) && equality.Semantic.DeepEqual(running.cfg.Connector.Spec, connector.Spec) {
+			return nil
+		}
+		if err := m.stop(ctx, connector.Name); err != nil {
+			return err
+		}
+	}
+	return m.start(connector)
+}
+
+// OnUpdate restarts the connector if its spec changed.
+func (m *Manager) OnUpdate(ctx context.Context, _, new *vanusv1alpha1.Connector) error {
+	return m.OnAdd(ctx, new)
+}
+
+// OnDelete stops the connector and waits for it to return until ctx is done.
+func (m *Manager) OnDelete(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+	return m.stop(ctx, connector.Name)
+}
+
+// OnStop implements ConnectorStopper, it's the same as OnDelete.
+func (m *Manager) OnStop(ctx context.Context, connectorID string) error {
+	return m.stop(ctx, connectorID)
+}
+
+// Running returns the IDs of the connectors being run, including those waiting to restart and
+// those which haven't returned since they were stopped, but not those given up.
+func (m *Manager) Running() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]string, 0, len(m.connectors))
+	for id := range m.connectors {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (m *Manager) get(id string) *managedConnector {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.connectors[id]
+}
+
+func (m *Manager) isStopping(mc *managedConnector) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return mc.stopping
+}
+
+// start creates the connector by its factory and runs it in a new goroutine, the error of
+// creating it is returned.
+func (m *Manager) start(connector *vanusv1alpha1.Connector) error {
+	cfg := ConnectorConfig{
+		ID:        connector.Name,
+		Kind:      connector.Spec.Kind,
+		Type:      connector.Spec.Type,
+		Config:    connector.Spec.Config,
+		Connector: connector.DeepCopy(),
+	}
+	m.mu.Lock()
+	factory, ok := m.factories[cfg.Type]
+	m.mu.Unlock()
+	if !ok {
+		return PermanentError(fmt.Errorf("no factory registered for connector type %q", cfg.Type))
+	}
+	instance, err := factory.New(cfg)
+	if err != nil {
+		return fmt.Errorf("create connector: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mc := &managedConnector{cfg: cfg, cancel: cancel, done: make(chan struct{})}
+	m.mu.Lock()
+	m.connectors[cfg.ID] = mc
+	m.mu.Unlock()
+	go m.run(ctx, mc, factory, instance)
+	log.Infof("connector %s started", cfg.ID)
+	return nil
+}
+
+// stop cancels the context of the connector and waits for it to return until ctx is done.
+// The connector is only forgotten once it returned, so a retry after a timeout waits again.
+func (m *Manager) stop(ctx context.Context, id string) error {
+	m.mu.Lock()
+	mc, ok := m.connectors[id]
+	if ok {
+		mc.stopping = true
+	}
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	mc.cancel()
+	select {
+	case <-mc.done:
+	case <-ctx.Done():
+		return fmt.Errorf("timeout waiting for connector %s to stop: %w", id, ctx.Err())
+	}
+	m.mu.Lock()
+	if m.connectors[id] == mc {
+		delete(m.connectors, id)
+	}
+	m.mu.Unlock()
+	log.Infof("connector %s stopped", id)
+	return nil
+}
+
+// run runs the connector until ctx is done, restarting it with backoff when it fails. A
+// restarted connector is only reported as Running again once it ran longer than MaxDelay, so
+// a crash looping one stays Degraded.
+func (m *Manager) run(ctx context.Context, mc *managedConnector, factory Factory, instance Connector) {
+	defer close(mc.done)
+	policy := m.opts.restartPolicy
+	failures := 0
+	for {
+		started := m.opts.clock.Now()
+		stopRecovery := func() {}
+		if failures > 0 {
+			stopRecovery = m.reportRecovery(mc.cfg.ID, policy.MaxDelay)
+		}
+		err := startConnector(ctx, instance, mc.cfg)
+		stopRecovery()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("connector returned before stopped")
+		}
+		if m.opts.clock.Since(started) > policy.MaxDelay {
+			failures = 0
+		}
+		failures++
+		if policy.MaxAttempts > 0 && failures >= policy.MaxAttempts {
+			log.Errorf("connector %s failed %d times, giving up: %+v", mc.cfg.ID, failures, err)
+			m.report(mc.cfg.ID, StateFailed, fmt.Sprintf("gave up after %d failures: %s", failures, err))
+			m.mu.Lock()
+			if m.connectors[mc.cfg.ID] == mc {
+				delete(m.connectors, mc.cfg.ID)
+			}
+			m.mu.Unlock()
+			return
+		}
+		delay := policy.backoff(failures - 1)
+		log.Errorf("connector %s failed, restarting in %s: %+v", mc.cfg.ID, delay, err)
+		m.report(mc.cfg.ID, StateDegraded, fmt.Sprintf("restarting in %s: %s", delay, err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.opts.clock.After(delay):
+		}
+
+		if instance, err = factory.New(mc.cfg); err != nil {
+			// retried as a failure of the connector
+			instance = failedConnector(fmt.Errorf("create connector: %w", err))
+			continue
+		}
+		log.Infof("connector %s restarted", mc.cfg.ID)
+	}
+}
+
+// reportRecovery reports the restarted connector as Running once it has run for d, unless the
+// returned function is called before.
+func (m *Manager) reportRecovery(id string, d time.Duration) func() {
+	timer := m.opts.clock.NewTimer(d)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-timer.C():
+			m.report(id, StateRunning, "recovered")
+		case <-stopped:
+			timer.Stop()
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+func (m *Manager) report(id string, state ConnectorState, message string) {
+	m.mu.Lock()
+	reporter := m.reporter
+	m.mu.Unlock()
+	if reporter == nil {
+		return
+	}
+	if err := reporter.ReportStatus(id, state, message); err != nil {
+		log.Errorf("report status of connector %s failed: %+v", id, err)
+	}
+}
+
+// failedConnector returns a connector failing with err.
+func failedConnector(err error) Connector {
+	return ConnectorFunc(func(context.Context, ConnectorConfig) error {
+		return err
+	})
+}
+
+// startConnector starts the connector, a panic of it is returned as an error.
+func startConnector(ctx context.Context, connector Connector, cfg ConnectorConfig) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("connector panicked: %v", r)
+		}
+	}()
+	return connector.Start(ctx, cfg)
+}
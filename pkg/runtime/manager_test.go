@@ -0,0 +1,234 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+)
+
+func TestManagerStopTimeout(t *testing.T) {
+	release := make(chan struct{})
+	var created atomic.Int32
+	m := runtime.NewManager()
+	m.Register("chatgpt", runtime.FactoryFunc(func(runtime.ConnectorConfig) (runtime.Connector, error) {
+		created.Add(1)
+		return runtime.ConnectorFunc(func(ctx context.Context, _ runtime.ConnectorConfig) error {
+			<-ctx.Done()
+			// slow to stop
+			<-release
+			return nil
+		}), nil
+	}))
+	connector := newConnector("a", nil)
+	if err := m.OnAdd(context.Background(), connector); err != nil {
+		t.Fatalf("failed to add connector: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.OnDelete(ctx, connector); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error deleting connector: %v", err)
+	}
+	// kept until it returns
+	if running := m.Running(); len(running) != 1 || running[0] != "a" {
+		t.Fatalf("connector is forgotten while still running: %v", running)
+	}
+
+	// added again before it returned, it's restarted once it returns
+	close(release)
+	if err := m.OnAdd(context.Background(), connector); err != nil {
+		t.Fatalf("failed to add connector: %v", err)
+	}
+	if n := created.Load(); n != 2 {
+		t.Fatalf("connector is not restarted, created %d times", n)
+	}
+	if err := m.OnDelete(context.Background(), connector); err != nil {
+		t.Fatalf("failed to delete connector: %v", err)
+	}
+	if running := m.Running(); len(running) != 0 {
+		t.Fatalf("connector is still running: %v", running)
+	}
+}
+
+// recordingReporter records the states reported.
+type recordingReporter struct {
+	mu     sync.Mutex
+	states []runtime.ConnectorState
+}
+
+func (r *recordingReporter) ReportStatus(_ string, state runtime.ConnectorState, _ string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states = append(r.states, state)
+	return nil
+}
+
+func (r *recordingReporter) reported() []runtime.ConnectorState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]runtime.ConnectorState(nil), r.states...)
+}
+
+func waitUntil(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return condition(), nil
+	})
+	if err != nil {
+		t.Fatalf("timeout waiting for %s", what)
+	}
+}
+
+// failingFactory creates connectors failing on the first failures starts, and running until
+// stopped afterwards.
+func failingFactory(failures int32, created *atomic.Int32) runtime.Factory {
+	return runtime.FactoryFunc(func(runtime.ConnectorConfig) (runtime.Connector, error) {
+		n := created.Add(1)
+		return runtime.ConnectorFunc(func(ctx context.Context, _ runtime.ConnectorConfig) error {
+			if failures < 0 || n <= failures {
+				return errors.New("boom")
+			}
+			<-ctx.Done()
+			return nil
+		}), nil
+	})
+}
+
+func TestManagerRestartOnSpecChange(t *testing.T) {
+	configs := make(chan string, 2)
+	stopped := make(chan string, 2)
+	m := runtime.NewManager()
+	m.Register("chatgpt", runtime.FactoryFunc(func(cfg runtime.ConnectorConfig) (runtime.Connector, error) {
+		configs <- cfg.Config
+		return runtime.ConnectorFunc(func(ctx context.Context, cfg runtime.ConnectorConfig) error {
+			<-ctx.Done()
+			stopped <- cfg.Config
+			return nil
+		}), nil
+	}))
+	ctx := context.Background()
+	old := newConnector("a", nil)
+	old.Spec.Config = "v1"
+	if err := m.OnAdd(ctx, old); err != nil {
+		t.Fatalf("failed to add connector: %v", err)
+	}
+	if config := <-configs; config != "v1" {
+		t.Fatalf("unexpected config %q", config)
+	}
+
+	// not restarted if the spec is the same
+	relabeled := old.DeepCopy()
+	relabeled.Labels = map[string]string{"app": "demo"}
+	if err := m.OnUpdate(ctx, old, relabeled); err != nil {
+		t.Fatalf("failed to update connector: %v", err)
+	}
+	select {
+	case config := <-configs:
+		t.Fatalf("connector is restarted with the same spec, config %q", config)
+	default:
+	}
+
+	updated := relabeled.DeepCopy()
+	updated.Spec.Config = "v2"
+	if err := m.OnUpdate(ctx, relabeled, updated); err != nil {
+		t.Fatalf("failed to update connector: %v", err)
+	}
+	if config := <-stopped; config != "v1" {
+		t.Fatalf("unexpected config of stopped connector %q", config)
+	}
+	if config := <-configs; config != "v2" {
+		t.Fatalf("connector is not restarted with the new spec, config %q", config)
+	}
+	if err := m.OnDelete(ctx, updated); err != nil {
+		t.Fatalf("failed to delete connector: %v", err)
+	}
+}
+
+func TestManagerRestartBackoff(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	reporter := &recordingReporter{}
+	var created atomic.Int32
+	m := runtime.NewManager(runtime.WithManagerClock(clock),
+		runtime.WithRestartPolicy(runtime.RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}))
+	m.InjectStatusReporter(reporter)
+	m.Register("chatgpt", failingFactory(3, &created))
+	connector := newConnector("a", nil)
+	if err := m.OnAdd(context.Background(), connector); err != nil {
+		t.Fatalf("failed to add connector: %v", err)
+	}
+	defer func() {
+		_ = m.OnDelete(context.Background(), connector)
+	}()
+
+	// the delay doubles from the base delay, extended by up to 10% of jitter
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		waitUntil(t, "restart to be scheduled", clock.HasWaiters)
+		clock.Step(delay - time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		if n := created.Load(); n != int32(i+1) {
+			t.Fatalf("restarted before %s, created %d times", delay, n)
+		}
+		clock.Step(delay / 5)
+		waitUntil(t, "restart", func() bool { return created.Load() == int32(i+2) })
+	}
+
+	// a crash looping connector is never reported as Running
+	for _, state := range reporter.reported() {
+		if state != runtime.StateDegraded {
+			t.Fatalf("unexpected states reported %v", reporter.reported())
+		}
+	}
+	// the restarted connector is Running once it ran longer than MaxDelay
+	waitUntil(t, "recovery to be scheduled", clock.HasWaiters)
+	clock.Step(time.Minute)
+	waitUntil(t, "connector to recover", func() bool {
+		states := reporter.reported()
+		return states[len(states)-1] == runtime.StateRunning
+	})
+}
+
+func TestManagerGiveUp(t *testing.T) {
+	clock := clocktesting.NewFakeClock(time.Now())
+	reporter := &recordingReporter{}
+	var created atomic.Int32
+	m := runtime.NewManager(runtime.WithManagerClock(clock),
+		runtime.WithRestartPolicy(runtime.RetryPolicy{BaseDelay: time.Second, MaxAttempts: 2}))
+	m.InjectStatusReporter(reporter)
+	m.Register("chatgpt", failingFactory(-1, &created))
+	if err := m.OnAdd(context.Background(), newConnector("a", nil)); err != nil {
+		t.Fatalf("failed to add connector: %v", err)
+	}
+
+	waitUntil(t, "restart to be scheduled", clock.HasWaiters)
+	clock.Step(2 * time.Second)
+	waitUntil(t, "connector to be given up", func() bool { return len(m.Running()) == 0 })
+	if n := created.Load(); n != 2 {
+		t.Fatalf("connector is created %d times", n)
+	}
+	states := reporter.reported()
+	if len(states) != 2 || states[0] != runtime.StateDegraded || states[1] != runtime.StateFailed {
+		t.Fatalf("unexpected states reported %v", states)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/util/workqueue"
+	log "k8s.io/klog/v2"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+)
+
+const metricsNamespace = "vanus_connect_runtime"
+
+const (
+	operationAdd       = "add"
+	operationUpdate    = "update"
+	operationDelete    = "delete"
+	operationReconcile = "reconcile"
+)
+
+// MetricsRegistry is the registry of all the metrics of runtime, it can be used to expose the
+// metrics through an existing HTTP server instead of the listener of WithMetricsAddress.
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	handlerCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_calls_total",
+		Help:      "Total number of handler invocations.",
+	}, []string{"operation", "kind", "type"})
+	handlerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_errors_total",
+		Help:      "Total number of handler invocations which returned an error.",
+	}, []string{"operation", "kind", "type"})
+	handlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Duration of handler invocations in seconds.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"operation", "kind", "type"})
+	managedConnectors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connectors",
+		Help:      "Number of connectors managed by the runtime by phase.",
+	}, []string{"runtime", "phase"})
+	informerSynced = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "informer_synced",
+		Help:      "Whether the connector informer of the runtime has synced, 1 if synced.",
+	}, []string{"runtime"})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		handlerCalls, handlerErrors, handlerDuration, managedConnectors, informerSynced,
+		workqueueMetrics.depth, workqueueMetrics.adds, workqueueMetrics.latency, workqueueMetrics.workDuration,
+		workqueueMetrics.unfinishedWork, workqueueMetrics.longestRunningProcessor, workqueueMetrics.retries,
+	)
+}
+
+// EnableWorkqueueMetrics makes the client-go workqueues created afterwards report their
+// metrics into MetricsRegistry. The provider of the workqueues is process-wide and can only be
+// set once, so it's only set by WithMetricsAddress or by calling this before New, e.g. when
+// MetricsRegistry is exposed through an existing HTTP server.
+func EnableWorkqueueMetrics() {
+	workqueue.SetProvider(workqueueMetrics)
+}
+
+// observeHandler invokes the handler by fn and records the invocation.
+func observeHandler(operation string, connector *vanusv1alpha1.Connector, fn func() error) error {
+	var kind, typ string
+	if connector != nil {
+		kind, typ = connector.Spec.Kind, connector.Spec.Type
+	}
+	start := time.Now()
+	err := fn()
+	handlerDuration.WithLabelValues(operation, kind, typ).Observe(time.Since(start).Seconds())
+	handlerCalls.WithLabelValues(operation, kind, typ).Inc()
+	if err != nil {
+		handlerErrors.WithLabelValues(operation, kind, typ).Inc()
+	}
+	return err
+}
+
+// runtimeMetrics are the metrics of a runtime, labeled by its identity.
+type runtimeMetrics struct {
+	identity string
+	synced   prometheus.Gauge
+	phases   *phaseTracker
+}
+
+func newRuntimeMetrics(identity string) *runtimeMetrics {
+	labels := prometheus.Labels{"runtime": identity}
+	return &runtimeMetrics{
+		identity: identity,
+		synced:   informerSynced.With(labels),
+		phases: &phaseTracker{
+			gauge:  managedConnectors.MustCurryWith(labels),
+			phases: map[string]vanusv1alpha1.ConnectorPhase{},
+		},
+	}
+}
+
+// delete removes the metrics of the runtime once it's stopped.
+func (m *runtimeMetrics) delete() {
+	labels := prometheus.Labels{"runtime": m.identity}
+	informerSynced.Delete(labels)
+	managedConnectors.DeletePartialMatch(labels)
+}
+
+// phaseTracker tracks the phase of managed connectors for the connectors metric.
+type phaseTracker struct {
+	gauge  *prometheus.GaugeVec
+	mu     sync.Mutex
+	phases map[string]vanusv1alpha1.ConnectorPhase
+}
+
+func (t *phaseTracker) set(key string, phase vanusv1alpha1.ConnectorPhase) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.phases[key]
+	if ok && old == phase {
+		return
+	}
+	if ok {
+		t.gauge.WithLabelValues(string(old)).Dec()
+	}
+	t.phases[key] = phase
+	t.gauge.WithLabelValues(string(phase)).Inc()
+}
+
+func (t *phaseTracker) forget(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.phases[key]; ok {
+		t.gauge.WithLabelValues(string(old)).Dec()
+		delete(t.phases, key)
+	}
+}
+
+// serveMetrics serves the metrics on addr until ctx is done.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(MetricsRegistry, promhttp.HandlerOpts{}))
+	serve(ctx, "metrics", addr, mux)
+}
+
+func serve(ctx context.Context, name, addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	log.Infof("Serving %s on %s", name, addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Errorf("failed to serve %s on %s: %+v", name, addr, err)
+	}
+}
+
+// workqueueMetrics provides the metrics of the workqueues used by runtime.
+var workqueueMetrics = newWorkqueueMetricsProvider()
+
+type workqueueMetricsProvider struct {
+	depth                   *prometheus.GaugeVec
+	adds                    *prometheus.CounterVec
+	latency                 *prometheus.HistogramVec
+	workDuration            *prometheus.HistogramVec
+	unfinishedWork          *prometheus.GaugeVec
+	longestRunningProcessor *prometheus.GaugeVec
+	retries                 *prometheus.CounterVec
+}
+
+func newWorkqueueMetricsProvider() *workqueueMetricsProvider {
+	const subsystem = "workqueue"
+	buckets := prometheus.ExponentialBuckets(10e-9, 10, 10)
+	return &workqueueMetricsProvider{
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Subsystem: subsystem,
+			Name: "depth",
+			Help: "Current depth of workqueue.",
+		}, []string{"name"}),
+		adds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: subsystem,
+			Name: "adds_total",
+			Help: "Total number of adds handled by workqueue.",
+		}, []string{"name"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: subsystem,
+			Name:    "queue_duration_seconds",
+			Help:    "How long in seconds an item stays in workqueue before being requested.",
+			Buckets: buckets,
+		}, []string{"name"}),
+		workDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: subsystem,
+			Name:    "work_duration_seconds",
+			Help:    "How long in seconds processing an item from workqueue takes.",
+			Buckets: buckets,
+		}, []string{"name"}),
+		unfinishedWork: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Subsystem: subsystem,
+			Name: "unfinished_work_seconds",
+			Help: "How many seconds of work has been done that is in progress and hasn't been observed by work_duration.",
+		}, []string{"name"}),
+		longestRunningProcessor: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Subsystem: subsystem,
+			Name: "longest_running_processor_seconds",
+			Help: "How many seconds has the longest running processor for workqueue been running.",
+		}, []string{"name"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: subsystem,
+			Name: "retries_total",
+			Help: "Total number of retries handled by workqueue.",
+		}, []string{"name"}),
+	}
+}
+
+func (p *workqueueMetricsProvider) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return p.depth.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewAddsMetric(name string) workqueue.CounterMetric {
+	return p.adds.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return p.latency.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return p.workDuration.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.unfinishedWork.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return p.longestRunningProcessor.WithLabelValues(name)
+}
+
+func (p *workqueueMetricsProvider) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return p.retries.WithLabelValues(name)
+}
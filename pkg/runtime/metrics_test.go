@@ -0,0 +1,94 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+// gatherMetric returns the series of the metric in runtime.MetricsRegistry.
+func gatherMetric(t *testing.T, name string) []*dto.Metric {
+	t.Helper()
+	families, err := runtime.MetricsRegistry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()
+		}
+	}
+	return nil
+}
+
+func labelValue(metric *dto.Metric, name string) string {
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == name {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestMetricsPerRuntime(t *testing.T) {
+	first := runtimetest.New(t, runtime.ConnectorHandlerFuncs{})
+	second := runtimetest.New(t, runtime.ConnectorHandlerFuncs{})
+	// the same connector in both runtimes
+	for _, h := range []*runtimetest.Harness{first, second} {
+		h.Create(newConnector("a", nil))
+		h.WaitForObserved("a")
+		h.WaitForIdle()
+	}
+
+	running := map[string]float64{}
+	for _, metric := range gatherMetric(t, "vanus_connect_runtime_connectors") {
+		if labelValue(metric, "phase") == "Running" {
+			running[labelValue(metric, "runtime")] += metric.GetGauge().GetValue()
+		}
+	}
+	if len(running) != 2 {
+		t.Fatalf("unexpected connectors by runtime: %v", running)
+	}
+	for id, n := range running {
+		if n != 1 {
+			t.Fatalf("unexpected running connectors of runtime %s: %v", id, n)
+		}
+	}
+
+	synced := 0
+	for _, metric := range gatherMetric(t, "vanus_connect_runtime_informer_synced") {
+		if metric.GetGauge().GetValue() == 1 {
+			synced++
+		}
+	}
+	if synced != 2 {
+		t.Fatalf("unexpected number of synced runtimes: %d", synced)
+	}
+}
+
+func TestWorkqueueMetricsOptIn(t *testing.T) {
+	// no test of the package enables the workqueue metrics
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{})
+	h.Create(newConnector("a", nil))
+	h.WaitForObserved("a")
+	if metrics := gatherMetric(t, "vanus_connect_runtime_workqueue_adds_total"); len(metrics) != 0 {
+		t.Fatalf("workqueue metrics are reported without opting in: %v", metrics)
+	}
+}
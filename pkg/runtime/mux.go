@@ -0,0 +1,270 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+)
+
+// Wildcard matches any kind or type of connectors in HandlerMux.Handle.
+const Wildcard = "*"
+
+// ErrNoHandler is returned for the connectors no handler is registered for, the runtime
+// reports the Ready condition of them as false with reason NoHandler.
+var ErrNoHandler = errors.New("no handler registered")
+
+// HandlerMux is a ConnectorHandler routing connectors to the handlers registered by their
+// Spec.Kind and Spec.Type. The most specific registration wins: an exact kind and type, then
+// an exact kind with any type, then any kind with an exact type and at last any kind and type.
+//
+// A connector whose type changes so that it's routed to another handler is deleted from the
+// old handler and added to the new one. The optional interfaces of the handlers are supported:
+// the StatusReporter is injected into all of them, the active connectors of all of them are
+// listed and a connector is stopped by the handler running it.
+type HandlerMux struct {
+	mu       sync.RWMutex
+	entries  map[muxPattern]*muxEntry
+	reporter StatusReporter
+	// routes is the handler each connector has been added to
+	routes map[string]*muxEntry
+}
+
+var (
+	_ ConnectorHandler       = &HandlerMux{}
+	_ ActiveConnectorLister  = &HandlerMux{}
+	_ ConnectorStopper       = &HandlerMux{}
+	_ StatusReporterInjector = &HandlerMux{}
+)
+
+type muxPattern struct {
+	kind string
+	typ  string
+}
+
+func (p muxPattern) String() string {
+	return fmt.Sprintf("kind %q and type %q", p.kind, p.typ)
+}
+
+type muxEntry struct {
+	pattern muxPattern
+	handler ConnectorHandler
+}
+
+// NewHandlerMux creates a HandlerMux without any handler registered.
+func NewHandlerMux() *HandlerMux {
+	return &HandlerMux{
+		entries: map[muxPattern]*muxEntry{},
+		routes:  map[string]*muxEntry{},
+	}
+}
+
+// Handle registers the handler of the connectors of kind and typ, either can be Wildcard. It
+// panics if a handler is already registered for them.
+func (m *HandlerMux) Handle(kind, typ string, handler ConnectorHandler) {
+	if handler == nil {
+		panic("runtime: nil handler")
+	}
+	pattern := muxPattern{kind: kind, typ: typ}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.entries[pattern]; ok {
+		panic(fmt.Sprintf("runtime: multiple registrations for %s", pattern))
+	}
+	m.entries[pattern] = &muxEntry{pattern: pattern, handler: handler}
+	if injector, ok := handler.(StatusReporterInjector); ok && m.reporter != nil {
+		injector.InjectStatusReporter(m.reporter)
+	}
+}
+
+// HandleEventHandler registers a ConnectorEventHandler the same as Handle.
+func (m *HandlerMux) HandleEventHandler(kind, typ string, handler ConnectorEventHandler) {
+	if handler == nil {
+		panic("runtime: nil handler")
+	}
+	m.Handle(kind, typ, AdaptEventHandler(handler))
+}
+
+// InjectStatusReporter injects the reporter into the handlers which want one.
+func (m *HandlerMux) InjectStatusReporter(reporter StatusReporter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reporter = reporter
+	for _, entry := range m.entries {
+		if injector, ok := entry.handler.(StatusReporterInjector); ok {
+			injector.InjectStatusReporter(reporter)
+		}
+	}
+}
+
+func (m *HandlerMux) OnAdd(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+	entry, err := m.match(connector)
+	if err != nil {
+		return err
+	}
+	if err = entry.handler.OnAdd(ctx, connector); err != nil {
+		return err
+	}
+	m.setRoute(connector.Name, entry)
+	return nil
+}
+
+// OnUpdate updates the connector by its handler, or deletes it from the old handler and adds
+// it to the new one if it's routed to another handler.
+func (m *HandlerMux) OnUpdate(ctx context.Context, old, new *vanusv1alpha1.Connector) error {
+	current := m.route(new.Name)
+	entry, matchErr := m.match(new)
+	if current != nil && current == entry {
+		return entry.handler.OnUpdate(ctx, old, new)
+	}
+	if current != nil {
+		if err := current.handler.OnDelete(ctx, old); err != nil {
+			return err
+		}
+		m.setRoute(new.Name, nil)
+	}
+	if matchErr != nil {
+		return matchErr
+	}
+	if err := entry.handler.OnAdd(ctx, new); err != nil {
+		return err
+	}
+	m.setRoute(new.Name, entry)
+	return nil
+}
+
+// OnDelete deletes the connector from the handler it has been added to. A connector which
+// hasn't been added since the mux was created, e.g. an orphan left by a previous run of the
+// runtime, is deleted from all the handlers listing it as active.
+func (m *HandlerMux) OnDelete(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+	current := m.route(connector.Name)
+	if current == nil {
+		owners, err := m.activeEntries(ctx, connector.Name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range owners {
+			if err = entry.handler.OnDelete(ctx, connector); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := current.handler.OnDelete(ctx, connector); err != nil {
+		return err
+	}
+	m.setRoute(connector.Name, nil)
+	return nil
+}
+
+// ActiveConnectors lists the active connectors of all the handlers which know them.
+func (m *HandlerMux) ActiveConnectors(ctx context.Context) ([]string, error) {
+	seen := map[string]struct{}{}
+	var ids []string
+	for _, entry := range m.listerEntries() {
+		active, err := entry.handler.(ActiveConnectorLister).ActiveConnectors(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range active {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// activeEntries returns the entries whose handler lists the connector as active.
+func (m *HandlerMux) activeEntries(ctx context.Context, connectorID string) ([]*muxEntry, error) {
+	var owners []*muxEntry
+	for _, entry := range m.listerEntries() {
+		active, err := entry.handler.(ActiveConnectorLister).ActiveConnectors(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range active {
+			if id == connectorID {
+				owners = append(owners, entry)
+				break
+			}
+		}
+	}
+	return owners, nil
+}
+
+// listerEntries returns the entries whose handler implements ActiveConnectorLister.
+func (m *HandlerMux) listerEntries() []*muxEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	entries := make([]*muxEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		if _, ok := entry.handler.(ActiveConnectorLister); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// OnStop stops the connector by the handler it has been added to if it supports it.
+func (m *HandlerMux) OnStop(ctx context.Context, connectorID string) error {
+	current := m.route(connectorID)
+	if current == nil {
+		return nil
+	}
+	if stopper, ok := current.handler.(ConnectorStopper); ok {
+		return stopper.OnStop(ctx, connectorID)
+	}
+	return nil
+}
+
+// match returns the most specific entry matching the connector.
+func (m *HandlerMux) match(connector *vanusv1alpha1.Connector) (*muxEntry, error) {
+	kind, typ := connector.Spec.Kind, connector.Spec.Type
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, pattern := range []muxPattern{
+		{kind: kind, typ: typ},
+		{kind: kind, typ: Wildcard},
+		{kind: Wildcard, typ: typ},
+		{kind: Wildcard, typ: Wildcard},
+	} {
+		if entry, ok := m.entries[pattern]; ok {
+			return entry, nil
+		}
+	}
+	return nil, PermanentError(fmt.Errorf("%w for %s", ErrNoHandler, muxPattern{kind: kind, typ: typ}))
+}
+
+func (m *HandlerMux) route(connectorID string) *muxEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.routes[connectorID]
+}
+
+func (m *HandlerMux) setRoute(connectorID string, entry *muxEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if entry == nil {
+		delete(m.routes, connectorID)
+		return
+	}
+	m.routes[connectorID] = entry
+}
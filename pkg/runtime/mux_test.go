@@ -0,0 +1,244 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+// activeHandler is a handler which knows the connectors it's running.
+type activeHandler struct {
+	mu     sync.Mutex
+	active map[string]bool
+}
+
+func newActiveHandler(ids ...string) *activeHandler {
+	h := &activeHandler{active: map[string]bool{}}
+	for _, id := range ids {
+		h.active[id] = true
+	}
+	return h
+}
+
+func (h *activeHandler) OnAdd(_ context.Context, connector *vanusv1alpha1.Connector) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.active[connector.Name] = true
+	return nil
+}
+
+func (h *activeHandler) OnUpdate(ctx context.Context, _, new *vanusv1alpha1.Connector) error {
+	return h.OnAdd(ctx, new)
+}
+
+func (h *activeHandler) OnDelete(_ context.Context, connector *vanusv1alpha1.Connector) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.active, connector.Name)
+	return nil
+}
+
+func (h *activeHandler) ActiveConnectors(context.Context) ([]string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ids := make([]string, 0, len(h.active))
+	for id := range h.active {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func TestHandlerMuxDeletesOrphans(t *testing.T) {
+	source := newActiveHandler("orphan")
+	sink := newActiveHandler("other")
+	mux := runtime.NewHandlerMux()
+	mux.Handle("source", runtime.Wildcard, source)
+	mux.Handle("sink", runtime.Wildcard, sink)
+
+	h := runtimetest.New(t, mux)
+	h.WaitForEvents(2)
+	h.WaitForIdle()
+	if active, _ := source.ActiveConnectors(context.Background()); len(active) != 0 {
+		t.Fatalf("orphans are still active: %v", active)
+	}
+	if active, _ := sink.ActiveConnectors(context.Background()); len(active) != 0 {
+		t.Fatalf("orphans are still active: %v", active)
+	}
+}
+
+func TestHandlerMuxDeleteWithoutRoute(t *testing.T) {
+	source := newActiveHandler("a")
+	sink := newActiveHandler("b")
+	mux := runtime.NewHandlerMux()
+	mux.Handle("source", runtime.Wildcard, source)
+	mux.Handle("sink", runtime.Wildcard, sink)
+
+	// deleted from the handler running it only, whatever its spec
+	if err := mux.OnDelete(context.Background(), newConnector("a", nil)); err != nil {
+		t.Fatalf("failed to delete connector: %v", err)
+	}
+	if active, _ := source.ActiveConnectors(context.Background()); len(active) != 0 {
+		t.Fatalf("connector is still active: %v", active)
+	}
+	if active, _ := sink.ActiveConnectors(context.Background()); len(active) != 1 {
+		t.Fatalf("connector of another handler is deleted: %v", active)
+	}
+	// nothing to do for connectors no handler knows
+	if err := mux.OnDelete(context.Background(), newConnector("c", nil)); err != nil {
+		t.Fatalf("failed to delete connector: %v", err)
+	}
+}
+
+// callLog records the calls of the handlers sharing it.
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) handler(name string) runtime.ConnectorHandler {
+	record := func(call string, connector *vanusv1alpha1.Connector) error {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.calls = append(l.calls, fmt.Sprintf("%s %s %s", name, call, connector.Name))
+		return nil
+	}
+	return runtime.ConnectorHandlerFuncs{
+		AddFunc: func(_ context.Context, connector *vanusv1alpha1.Connector) error {
+			return record("add", connector)
+		},
+		UpdateFunc: func(_ context.Context, _, new *vanusv1alpha1.Connector) error {
+			return record("update", new)
+		},
+		DeleteFunc: func(_ context.Context, connector *vanusv1alpha1.Connector) error {
+			return record("delete", connector)
+		},
+	}
+}
+
+func (l *callLog) recorded() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.calls...)
+}
+
+func TestHandlerMuxMatch(t *testing.T) {
+	calls := &callLog{}
+	mux := runtime.NewHandlerMux()
+	mux.Handle("source", "chatgpt", calls.handler("exact"))
+	mux.Handle("source", runtime.Wildcard, calls.handler("kind"))
+	mux.Handle(runtime.Wildcard, "chatgpt", calls.handler("type"))
+	mux.Handle(runtime.Wildcard, runtime.Wildcard, calls.handler("any"))
+
+	for _, tc := range []struct {
+		kind, typ string
+		want      string
+	}{
+		{kind: "source", typ: "chatgpt", want: "exact"},
+		{kind: "source", typ: "http", want: "kind"},
+		{kind: "sink", typ: "chatgpt", want: "type"},
+		{kind: "sink", typ: "http", want: "any"},
+	} {
+		name := tc.kind + "-" + tc.typ
+		connector := newConnector(name, nil)
+		connector.Spec.Kind, connector.Spec.Type = tc.kind, tc.typ
+		if err := mux.OnAdd(context.Background(), connector); err != nil {
+			t.Fatalf("failed to add connector %s: %v", name, err)
+		}
+		calls := calls.recorded()
+		if got, want := calls[len(calls)-1], tc.want+" add "+name; got != want {
+			t.Errorf("connector of kind %q and type %q is routed to %q, want %q", tc.kind, tc.typ, got, want)
+		}
+	}
+}
+
+func TestHandlerMuxTypeChange(t *testing.T) {
+	calls := &callLog{}
+	mux := runtime.NewHandlerMux()
+	mux.Handle("source", "chatgpt", calls.handler("chatgpt"))
+	mux.Handle("source", runtime.Wildcard, calls.handler("source"))
+	h := runtimetest.New(t, mux)
+
+	h.Create(newConnector("a", nil))
+	h.WaitForObserved("a")
+	// the type change is delivered to the mux as an update
+	connector := h.Get("a")
+	connector.Spec.Type = "http"
+	h.Update(connector)
+	h.WaitForObserved("a")
+	// the type change back is handled the same
+	connector = h.Get("a")
+	connector.Spec.Type = "chatgpt"
+	h.Update(connector)
+	h.WaitForObserved("a")
+	h.WaitForIdle()
+
+	h.ExpectEvents(
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a", Generation: 1},
+		runtimetest.Event{Type: runtimetest.EventUpdate, ConnectorID: "a", Generation: 2},
+		runtimetest.Event{Type: runtimetest.EventUpdate, ConnectorID: "a", Generation: 3},
+	)
+	want := []string{
+		"chatgpt add a",
+		"chatgpt delete a", "source add a",
+		"source delete a", "chatgpt add a",
+	}
+	if got := calls.recorded(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected calls %v, want %v", got, want)
+	}
+}
+
+func TestHandlerMuxNoHandler(t *testing.T) {
+	calls := &callLog{}
+	mux := runtime.NewHandlerMux()
+	mux.Handle("source", runtime.Wildcard, calls.handler("source"))
+	h := runtimetest.New(t, mux)
+
+	connector := newConnector("a", nil)
+	connector.Spec.Kind = "sink"
+	h.Create(connector)
+	h.WaitForObserved("a")
+	h.WaitForIdle()
+	status := h.Get("a").Status
+	if status.Phase != vanusv1alpha1.ConnectorFailed {
+		t.Fatalf("unexpected phase %s", status.Phase)
+	}
+	ready := meta.FindStatusCondition(status.Conditions, vanusv1alpha1.ConnectorReady)
+	if ready == nil || ready.Status != metav1.ConditionFalse || ready.Reason != "NoHandler" {
+		t.Fatalf("unexpected Ready condition %+v", ready)
+	}
+	// not retried as no handler can be registered in the meantime
+	h.Step(time.Minute)
+	h.WaitForIdle()
+	if n := len(h.Events()); n != 1 {
+		t.Fatalf("connector without handler is retried, %d invocations", n)
+	}
+	if got := calls.recorded(); len(got) != 0 {
+		t.Fatalf("unexpected calls %v", got)
+	}
+}
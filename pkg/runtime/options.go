@@ -14,11 +14,42 @@
 
 package runtime
 
+import (
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/utils/clock"
+
+	clientset "github.com/vanus-labs/vanus-connect-runtime/pkg/client/clientset/versioned"
+)
+
 type ConnectorOption func(opt *connectorOptions)
 
 type connectorOptions struct {
-	labelSelector string
-	handler       ConnectorEventHandler
+	labelSelector        string
+	filter               FilterConnector
+	handler              ConnectorHandler
+	reconciler           Reconciler
+	statusReportInterval time.Duration
+	finalizer            string
+	watchLabels          bool
+	watchAnnotations     []string
+	leaderElection       *leaderElectionOptions
+	sharding             *shardingOptions
+	leaseNamespace       string
+	leasePeriod          time.Duration
+	metricsAddr          string
+	startupTimeout       time.Duration
+	drainTimeout         time.Duration
+	workers              int
+	retryPolicy          RetryPolicy
+	healthProbeAddr      string
+	healthzChecks        map[string]Checker
+	readyzChecks         map[string]Checker
+	client               clientOptions
+	store                Store
+	clock                clock.WithTicker
 }
 
 func newConnectorOptions(options ...ConnectorOption) connectorOptions {
@@ -31,28 +62,258 @@ func newConnectorOptions(options ...ConnectorOption) connectorOptions {
 }
 
 func defaultConnectorOptions() connectorOptions {
-	defaultHandler := ConnectorEventHandlerFuncs{
-		AddFunc: func(connectorID, config string) error {
-			return nil
-		},
-		UpdateFunc: func(connectorID, config string) error {
-			return nil
-		},
-		DeleteFunc: func(connectorID string) error {
-			return nil
-		},
+	return connectorOptions{
+		handler:              ConnectorHandlerFuncs{},
+		statusReportInterval: defaultStatusReportInterval,
+		workers:              1,
+		retryPolicy:          DefaultRetryPolicy(),
+		leasePeriod:          defaultRetryPeriod,
+		clock:                clock.RealClock{},
 	}
-	return connectorOptions{handler: defaultHandler}
 }
 
+// WithFilter sets the label selector of the connectors handled by the runtime. A connector
+// relabeled out of the selector is handled as deleted and one relabeled into it as added, the
+// selector can be changed at runtime with Runtime.SetFilter.
 func WithFilter(filter string) ConnectorOption {
 	return func(opt *connectorOptions) {
 		opt.labelSelector = filter
 	}
 }
 
+// WithConnectorFilter selects the connectors handled by the runtime on the client side, it's
+// applied on top of the label selector set by WithFilter.
+func WithConnectorFilter(filter FilterConnector) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.filter = filter
+	}
+}
+
 func WithEventHandler(handler ConnectorEventHandler) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.handler = AdaptEventHandler(handler)
+	}
+}
+
+// WithHandler sets the context aware handler, it replaces the one set by WithEventHandler.
+func WithHandler(handler ConnectorHandler) ConnectorOption {
 	return func(opt *connectorOptions) {
 		opt.handler = handler
 	}
 }
+
+// WithReconciler sets the level-triggered reconciler, it takes precedence over the event handler.
+func WithReconciler(reconciler Reconciler) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.reconciler = reconciler
+	}
+}
+
+// WithStatusReportInterval sets the minimum interval between two status writes of the same
+// connector caused by ReportStatus, reports within the interval are coalesced.
+func WithStatusReportInterval(interval time.Duration) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.statusReportInterval = interval
+	}
+}
+
+// WithFinalizer enables the finalizer mode, the runtime adds the finalizer to every connector
+// it handles and removes it only after OnDelete succeeded, so deletions are never missed even
+// if the runtime is down when a connector is deleted. DefaultFinalizer is used if name is empty.
+func WithFinalizer(name string) ConnectorOption {
+	return func(opt *connectorOptions) {
+		if name == "" {
+			name = DefaultFinalizer
+		}
+		opt.finalizer = name
+	}
+}
+
+// WithWatchLabels makes the runtime call OnUpdate when the labels of a connector changed, by
+// default only changes of the spec are delivered to the handler.
+func WithWatchLabels() ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.watchLabels = true
+	}
+}
+
+// WithWatchAnnotations makes the runtime call OnUpdate when any of the given annotations of a
+// connector changed, by default only changes of the spec are delivered to the handler.
+func WithWatchAnnotations(keys ...string) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.watchAnnotations = append(opt.watchAnnotations, keys...)
+	}
+}
+
+// WithLeaderElection enables leader election through the lease in namespace, only the leader
+// handles connectors, so multiple replicas of runtime can be deployed for high availability.
+// A replica taking over adds all the connectors again, and releases them by OnDelete as soon as
+// renewing the lease fails.
+func WithLeaderElection(leaseName, namespace string) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.leaderElection = &leaderElectionOptions{
+			leaseName:     leaseName,
+			namespace:     namespace,
+			leaseDuration: defaultLeaseDuration,
+			renewDeadline: defaultRenewDeadline,
+			retryPeriod:   defaultRetryPeriod,
+		}
+	}
+}
+
+// WithSharding spreads the connectors over all the replicas of runtime in the same group by
+// consistent hashing of the connector name, the members of the group are discovered through
+// their leases in namespace. A replica calls OnDelete for the connectors it gives up and OnAdd
+// for the ones it acquires when a replica joins or leaves. It can't be used together with
+// WithLeaderElection.
+func WithSharding(group, namespace string) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.sharding = &shardingOptions{
+			group:     group,
+			namespace: namespace,
+			period:    defaultRetryPeriod,
+		}
+	}
+}
+
+// WithConnectorLeases makes the runtime hold an ownership lease in namespace for every
+// connector it runs, a connector is only added after its lease is acquired and is deleted
+// proactively once the lease can't be renewed, so a partitioned runtime stops the connector
+// before another one takes it over.
+func WithConnectorLeases(namespace string) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.leaseNamespace = namespace
+	}
+}
+
+// WithMetricsAddress serves the Prometheus metrics of runtime on addr under /metrics.
+func WithMetricsAddress(addr string) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.metricsAddr = addr
+	}
+}
+
+// WithHealthProbeAddress serves the liveness and readiness probes of runtime on addr under
+// /healthz and /readyz.
+func WithHealthProbeAddress(addr string) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.healthProbeAddr = addr
+	}
+}
+
+// WithHealthzCheck adds a liveness check served under /healthz, e.g. provided by the handler.
+func WithHealthzCheck(name string, check Checker) ConnectorOption {
+	return func(opt *connectorOptions) {
+		if opt.healthzChecks == nil {
+			opt.healthzChecks = map[string]Checker{}
+		}
+		opt.healthzChecks[name] = check
+	}
+}
+
+// WithReadyzCheck adds a readiness check served under /readyz, e.g. provided by the handler.
+func WithReadyzCheck(name string, check Checker) ConnectorOption {
+	return func(opt *connectorOptions) {
+		if opt.readyzChecks == nil {
+			opt.readyzChecks = map[string]Checker{}
+		}
+		opt.readyzChecks[name] = check
+	}
+}
+
+// WithStartupTimeout bounds the startup of Run, it fails if the caches haven't synced in time.
+func WithStartupTimeout(timeout time.Duration) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.startupTimeout = timeout
+	}
+}
+
+// WithGracefulShutdown makes Run wait up to drainTimeout for the in-flight handler invocations
+// and the workers to exit once ctx is done, then stop all the running connectors by OnStop if
+// the handler implements ConnectorStopper. The context of the in-flight invocations is only
+// canceled once the drain timeout expires.
+func WithGracefulShutdown(drainTimeout time.Duration) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.drainTimeout = drainTimeout
+	}
+}
+
+// WithWorkers sets the number of workers syncing connectors concurrently, a single connector
+// is still never synced by two workers at the same time.
+func WithWorkers(n int) ConnectorOption {
+	return func(opt *connectorOptions) {
+		if n < 1 {
+			n = 1
+		}
+		opt.workers = n
+	}
+}
+
+// WithRetryPolicy sets how connectors are retried after the handler returned an error, the
+// zero fields of policy are taken from DefaultRetryPolicy.
+func WithRetryPolicy(policy RetryPolicy) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.retryPolicy = policy.withDefaults(DefaultRetryPolicy())
+	}
+}
+
+// WithRestConfig sets the rest config used to build the clients instead of loading kubeconfig.
+func WithRestConfig(config *rest.Config) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.client.restConfig = config
+	}
+}
+
+// WithVanusClient sets the client of connectors, e.g. the fake clientset in unit tests.
+func WithVanusClient(client clientset.Interface) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.client.vanusClient = client
+	}
+}
+
+// WithKubeClient sets the kubernetes client, it's used for leases.
+func WithKubeClient(client kubernetes.Interface) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.client.kubeClient = client
+	}
+}
+
+// WithKubeconfigPath loads kubeconfig from path instead of $KUBECONFIG or $HOME/.kube/config.
+func WithKubeconfigPath(path string) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.client.kubeconfigPath = path
+	}
+}
+
+// WithKubeContext uses the context of kubeconfig instead of the current one.
+func WithKubeContext(name string) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.client.kubeContext = name
+	}
+}
+
+// WithClientRateLimits sets the QPS and burst of the clients built by runtime.
+func WithClientRateLimits(qps float32, burst int) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.client.qps = qps
+		opt.client.burst = burst
+	}
+}
+
+// WithStore sets the backend the runtime watches connectors from, the connector resource of
+// Kubernetes is watched by default. The label selector set by WithFilter is applied to the
+// store if it's a FilterableStore. The Kubernetes clients are only built if they are required
+// by leader election, sharding or connector leases.
+func WithStore(store Store) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.store = store
+	}
+}
+
+// WithClock sets the clock the runtime schedules retries and status reports by, it's used to
+// fake the time in tests.
+func WithClock(clock clock.WithTicker) ConnectorOption {
+	return func(opt *connectorOptions) {
+		opt.clock = clock
+	}
+}
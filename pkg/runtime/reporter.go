@@ -0,0 +1,188 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/util/workqueue"
+	log "k8s.io/klog/v2"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+)
+
+// ConnectorState is the health of a running connector reported by its handler.
+type ConnectorState string
+
+const (
+	// StateRunning means the connector works as expected.
+	StateRunning ConnectorState = "Running"
+	// StateDegraded means the connector is running but not working as expected,
+	// e.g. a source connector lost the connection to its upstream.
+	StateDegraded ConnectorState = "Degraded"
+	// StateFailed means the connector stopped working.
+	StateFailed ConnectorState = "Failed"
+)
+
+const (
+	reasonReported = "Reported"
+
+	defaultStatusReportInterval = 5 * time.Second
+	statusReportQPS             = 10
+	statusReportBurst           = 100
+)
+
+// StatusReporter reports the health of running connectors into their status.
+type StatusReporter interface {
+	// ReportStatus records the state of connector, reports of the same connector are
+	// coalesced and written asynchronously, only the latest one is guaranteed to be written.
+	ReportStatus(connectorID string, state ConnectorState, message string) error
+}
+
+// StatusReporterInjector is implemented by handlers which want to report connector health,
+// the runtime injects its StatusReporter into the handler when it is created.
+type StatusReporterInjector interface {
+	InjectStatusReporter(reporter StatusReporter)
+}
+
+type statusReport struct {
+	state   ConnectorState
+	message string
+}
+
+type statusReporter struct {
+	r        *runtime
+	interval time.Duration
+	limiter  *rate.Limiter
+	queue    workqueue.RateLimitingInterface
+
+	mu        sync.Mutex
+	pending   map[string]statusReport
+	lastWrite map[string]time.Time
+}
+
+func newStatusReporter(r *runtime, interval time.Duration) *statusReporter {
+	return &statusReporter{
+		r:        r,
+		interval: interval,
+		limiter:  rate.NewLimiter(rate.Limit(statusReportQPS), statusReportBurst),
+		queue: workqueue.NewRateLimitingQueueWithDelayingInterface(
+			workqueue.NewDelayingQueueWithCustomClock(r.clock, "ConnectorStatus"),
+			workqueue.DefaultControllerRateLimiter()),
+		pending:   map[string]statusReport{},
+		lastWrite: map[string]time.Time{},
+	}
+}
+
+func (s *statusReporter) ReportStatus(connectorID string, state ConnectorState, message string) error {
+	switch state {
+	case StateRunning, StateDegraded, StateFailed:
+	default:
+		return fmt.Errorf("unknown connector state %q", state)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[connectorID] = statusReport{state: state, message: message}
+	// the queue deduplicates the key, so all reports before the next write are coalesced
+	delay := s.lastWrite[connectorID].Add(s.interval).Sub(s.r.clock.Now())
+	if delay > 0 {
+		s.queue.AddAfter(connectorID, delay)
+	} else {
+		s.queue.Add(connectorID)
+	}
+	return nil
+}
+
+func (s *statusReporter) run(ctx context.Context) {
+	for s.processNextWorkItem(ctx) {
+	}
+}
+
+func (s *statusReporter) processNextWorkItem(ctx context.Context) bool {
+	obj, shutdown := s.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer s.queue.Done(obj)
+
+	key := obj.(string)
+	s.mu.Lock()
+	report, ok := s.pending[key]
+	delete(s.pending, key)
+	s.mu.Unlock()
+	if !ok {
+		s.queue.Forget(obj)
+		return true
+	}
+
+	if err := s.limiter.Wait(ctx); err != nil {
+		return true
+	}
+	if err := s.write(ctx, key, report); err != nil {
+		s.mu.Lock()
+		// keep the newer report if one arrived during the write
+		if _, exist := s.pending[key]; !exist {
+			s.pending[key] = report
+		}
+		s.mu.Unlock()
+		s.queue.AddRateLimited(key)
+		utilruntime.HandleError(fmt.Errorf("error reporting status of connector '%s': %s, requeuing", key, err.Error()))
+		return true
+	}
+	s.queue.Forget(obj)
+	s.mu.Lock()
+	s.lastWrite[key] = s.r.clock.Now()
+	s.mu.Unlock()
+	return true
+}
+
+func (s *statusReporter) write(ctx context.Context, key string, report statusReport) error {
+	log.Infof("report connector %s status %s: %s", key, report.state, report.message)
+	return s.r.updateStatus(ctx, key, func(status *vanusv1alpha1.ConnectorStatus) {
+		switch report.state {
+		case StateRunning:
+			setPhase(status, vanusv1alpha1.ConnectorRunning)
+			status.LastError = ""
+			setCondition(status, vanusv1alpha1.ConnectorReady, metav1.ConditionTrue, reasonReported, report.message)
+			setCondition(status, vanusv1alpha1.ConnectorDegraded, metav1.ConditionFalse, reasonReported, report.message)
+		case StateDegraded:
+			setPhase(status, vanusv1alpha1.ConnectorRunning)
+			setCondition(status, vanusv1alpha1.ConnectorReady, metav1.ConditionTrue, reasonReported, report.message)
+			setCondition(status, vanusv1alpha1.ConnectorDegraded, metav1.ConditionTrue, reasonReported, report.message)
+		case StateFailed:
+			setPhase(status, vanusv1alpha1.ConnectorFailed)
+			status.LastError = report.message
+			setCondition(status, vanusv1alpha1.ConnectorReady, metav1.ConditionFalse, reasonReported, report.message)
+		}
+	})
+}
+
+func (s *statusReporter) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, key)
+	delete(s.lastWrite, key)
+}
+
+func (s *statusReporter) shutdown() {
+	s.queue.ShutDown()
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// RetryPolicy controls how a connector is retried after its handler returned an error. The
+// zero fields are taken from the default policy of the option it's given to.
+type RetryPolicy struct {
+	// BaseDelay is the delay of the first retry, it doubles on every failure.
+	BaseDelay time.Duration
+	// MaxDelay is the upper bound of the delay.
+	MaxDelay time.Duration
+	// MaxAttempts is the max number of attempts before giving up, 0 means retrying forever.
+	MaxAttempts int
+	// Jitter randomly extends the delay by up to the fraction of it, e.g. 0.1 for 10%.
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns the retry policy used if WithRetryPolicy is not given, which is
+// the same as workqueue.DefaultControllerRateLimiter.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		BaseDelay: 5 * time.Millisecond,
+		MaxDelay:  1000 * time.Second,
+	}
+}
+
+// withDefaults returns the policy with its zero fields taken from defaults.
+func (p RetryPolicy) withDefaults(defaults RetryPolicy) RetryPolicy {
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaults.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaults.MaxDelay
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = defaults.MaxAttempts
+	}
+	if p.Jitter <= 0 {
+		p.Jitter = defaults.Jitter
+	}
+	return p
+}
+
+// backoff returns the delay after the given number of previous failures, it's capped by
+// MaxDelay, or by the max duration if MaxDelay is not set.
+func (p RetryPolicy) backoff(failures int) time.Duration {
+	maxDelay := float64(math.MaxInt64)
+	if p.MaxDelay > 0 {
+		maxDelay = float64(p.MaxDelay.Nanoseconds())
+	}
+	backoff := float64(p.BaseDelay.Nanoseconds()) * math.Pow(2, float64(failures))
+	if backoff > maxDelay {
+		backoff = maxDelay
+	}
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * rand.Float64() //nolint:gosec // no need to be secure
+	}
+	if backoff >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(backoff)
+}
+
+// PermanentError wraps err to tell the runtime the failure can't be fixed by retrying, the
+// connector is not retried and marked as Failed until it's changed.
+func PermanentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanentError returns true if err or any error it wraps is returned by PermanentError.
+func IsPermanentError(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// newRetryRateLimiter returns the rate limiter of the retry policy, the overall retries are
+// limited the same as workqueue.DefaultControllerRateLimiter.
+func newRetryRateLimiter(policy RetryPolicy) workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		&backoffRateLimiter{policy: policy, failures: map[interface{}]int{}},
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+// backoffRateLimiter is an exponential per item rate limiter with jitter.
+type backoffRateLimiter struct {
+	policy RetryPolicy
+
+	mu       sync.Mutex
+	failures map[interface{}]int
+}
+
+func (l *backoffRateLimiter) When(item interface{}) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	exp := l.failures[item]
+	l.failures[item] = exp + 1
+	return l.policy.backoff(exp)
+}
+
+func (l *backoffRateLimiter) NumRequeues(item interface{}) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.failures[item]
+}
+
+func (l *backoffRateLimiter) Forget(item interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, item)
+}
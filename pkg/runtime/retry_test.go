@@ -0,0 +1,73 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{},
+		runtime.WithRetryPolicy(runtime.RetryPolicy{MaxAttempts: 3}))
+	boom := errors.New("boom")
+	start := h.Clock().Now()
+
+	h.FailNext(runtimetest.EventAdd, "a", 3, boom)
+	h.Create(newConnector("a", nil))
+	h.WaitForEvents(1)
+	// the delays are taken from the default policy
+	h.Step(time.Millisecond)
+	h.WaitForIdle()
+	if n := len(h.Events()); n != 1 {
+		t.Fatalf("retried without backoff, %d invocations", n)
+	}
+	h.Step(4 * time.Millisecond)
+	h.WaitForEvents(2)
+	h.Step(10 * time.Millisecond)
+	h.WaitForEvents(3)
+	h.WaitForIdle()
+
+	h.ExpectEvents(
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a", Time: start, Err: boom},
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a", Time: start.Add(5 * time.Millisecond), Err: boom},
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a", Time: start.Add(15 * time.Millisecond), Err: boom},
+	)
+	// given up after MaxAttempts
+	if phase := h.Get("a").Status.Phase; phase != vanusv1alpha1.ConnectorFailed {
+		t.Fatalf("unexpected phase %s", phase)
+	}
+}
+
+func TestRetryPolicyBackoffCapped(t *testing.T) {
+	policy := runtime.RetryPolicy{BaseDelay: time.Second}
+	for _, failures := range []int{62, 100, 10000} {
+		if got := runtime.Backoff(policy, failures); got != time.Duration(math.MaxInt64) {
+			t.Fatalf("unexpected backoff after %d failures: %s", failures, got)
+		}
+	}
+	policy = runtime.RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: 0.1}
+	for _, failures := range []int{10, 100, 10000} {
+		if got := runtime.Backoff(policy, failures); got < time.Minute || got > 66*time.Second {
+			t.Fatalf("unexpected backoff after %d failures: %s", failures, got)
+		}
+	}
+}
@@ -16,116 +16,320 @@ package runtime
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 	log "k8s.io/klog/v2"
+	"k8s.io/utils/clock"
 
-	vanusinformer "github.com/vanus-labs/vanus-connect-runtime/pkg/client/informers/externalversions"
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
 	vanuslister "github.com/vanus-labs/vanus-connect-runtime/pkg/client/listers/vanus/v1alpha1"
 )
 
 type Runtime interface {
-	Run(ctx context.Context)
+	StatusReporter
+	Run(ctx context.Context) error
 	Lister() vanuslister.ConnectorLister
+	SetFilter(ctx context.Context, filter string) error
+	WaitForReady(ctx context.Context) error
 }
 
 type runtime struct {
-	connectorsLister     vanuslister.ConnectorLister
-	connectorSynced      cache.InformerSynced
-	addConnectorQueue    workqueue.RateLimitingInterface
-	updateConnectorQueue workqueue.RateLimitingInterface
-	deleteConnectorQueue workqueue.RateLimitingInterface
-	vanusInformerFactory vanusinformer.SharedInformerFactory
-
-	handler ConnectorEventHandler
+	kubeClient     kubernetes.Interface
+	connectorQueue workqueue.RateLimitingInterface
+	retryPolicy    RetryPolicy
+	identity       string
+	clock          clock.WithTicker
+
+	store      Store
+	storeLock  sync.RWMutex
+	filterLock sync.Mutex
+	started    bool
+	filter     FilterConnector
+	// stopped is set once the runtime is shutting down, the store must not be replaced
+	// afterwards
+	stopped bool
+
+	// applied is the connectors last applied to the handler, keyed by connector key
+	applied     map[string]*vanusv1alpha1.Connector
+	appliedLock sync.RWMutex
+	// syncLock is held by workers while syncing a connector
+	syncLock sync.RWMutex
+
+	handler    ConnectorHandler
+	reconciler Reconciler
+	reporter   *statusReporter
+	finalizer  string
+
+	watchLabels      bool
+	watchAnnotations []string
+	leaderElection   *leaderElectionOptions
+	sharder          *sharder
+	leases           *connectorLeases
+	metricsAddr      string
+	metrics          *runtimeMetrics
+	startupTimeout   time.Duration
+
+	healthProbeAddr    string
+	healthzExtraChecks map[string]Checker
+	readyzExtraChecks  map[string]Checker
+	readyCh            chan struct{}
+	readyOnce          sync.Once
+	activeWorkers      atomic.Int32
+	// startErr is the error Run failed to start with, it's set before readyCh is closed
+	startErr error
+	// syncing is the number of connectors being synced by workers
+	syncing atomic.Int32
+
+	workers      sync.WaitGroup
+	shutdownOnce sync.Once
+	drainTimeout time.Duration
+	workerCount  int
 }
 
 // New creates a new connect runtime
 func New(opts ...ConnectorOption) (Runtime, error) {
-	config, err := NewConfig()
-	if err != nil {
-		return nil, err
-	}
-
 	defaultOpts := defaultConnectorOptions()
 	for _, apply := range opts {
 		apply(&defaultOpts)
 	}
+	if err := defaultOpts.filter.validate(); err != nil {
+		return nil, err
+	}
+	if defaultOpts.leaderElection != nil && defaultOpts.sharding != nil {
+		return nil, errors.New("leader election and sharding are mutually exclusive")
+	}
+	store, kubeClient, err := newStore(defaultOpts)
+	if err != nil {
+		return nil, err
+	}
+	if defaultOpts.metricsAddr != "" {
+		// before the queues are created
+		EnableWorkqueueMetrics()
+	}
 
-	vanusInformerFactory := vanusinformer.NewSharedInformerFactoryWithOptions(config.VanusFactoryClient, 0,
-		vanusinformer.WithTweakListOptions(func(listOption *metav1.ListOptions) {
-			listOption.AllowWatchBookmarks = true
-			listOption.LabelSelector = defaultOpts.labelSelector
-		}))
-
-	connectorInformer := vanusInformerFactory.Vanus().V1alpha1().Connectors()
 	r := &runtime{
-		connectorsLister:     connectorInformer.Lister(),
-		connectorSynced:      connectorInformer.Informer().HasSynced,
-		addConnectorQueue:    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "AddConnector"),
-		updateConnectorQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "UpdateConnector"),
-		deleteConnectorQueue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "DeleteConnector"),
-		vanusInformerFactory: vanusInformerFactory,
-		handler:              defaultOpts.handler,
-	}
-
-	if _, err = connectorInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    r.enqueueAddConnector,
-		UpdateFunc: r.enqueueUpdateConnector,
-		DeleteFunc: r.enqueueDeleteConnector,
-	}); err != nil {
-		log.Errorf("failed to add connector event handler: %+v\n", err)
-		return nil, err
+		kubeClient: kubeClient,
+		store:      store,
+		identity:   identity(),
+		connectorQueue: workqueue.NewRateLimitingQueueWithDelayingInterface(
+			workqueue.NewDelayingQueueWithCustomClock(defaultOpts.clock, "Connector"),
+			newRetryRateLimiter(defaultOpts.retryPolicy)),
+		clock:            defaultOpts.clock,
+		retryPolicy:      defaultOpts.retryPolicy,
+		filter:           defaultOpts.filter,
+		applied:          map[string]*vanusv1alpha1.Connector{},
+		handler:          defaultOpts.handler,
+		reconciler:       defaultOpts.reconciler,
+		finalizer:        defaultOpts.finalizer,
+		watchLabels:      defaultOpts.watchLabels,
+		watchAnnotations: defaultOpts.watchAnnotations,
+		leaderElection:   defaultOpts.leaderElection,
+		metricsAddr:      defaultOpts.metricsAddr,
+		startupTimeout:   defaultOpts.startupTimeout,
+
+		healthProbeAddr:    defaultOpts.healthProbeAddr,
+		healthzExtraChecks: defaultOpts.healthzChecks,
+		readyzExtraChecks:  defaultOpts.readyzChecks,
+		readyCh:            make(chan struct{}),
+		drainTimeout:       defaultOpts.drainTimeout,
+		workerCount:        defaultOpts.workers,
+	}
+	r.metrics = newRuntimeMetrics(r.identity)
+	r.reporter = newStatusReporter(r, defaultOpts.statusReportInterval)
+	if defaultOpts.sharding != nil {
+		r.sharder = newSharder(r, *defaultOpts.sharding)
+	}
+	if defaultOpts.leaseNamespace != "" {
+		r.leases = newConnectorLeases(r, defaultOpts.leaseNamespace, defaultOpts.leasePeriod)
+	}
+	for _, h := range []interface{}{r.handler, r.reconciler} {
+		if injector, ok := h.(StatusReporterInjector); ok {
+			injector.InjectStatusReporter(r)
+		}
 	}
 
+	if err = r.addEventHandler(r.store); err != nil {
+		return nil, err
+	}
 	return r, nil
 }
 
-// Run begins runtime.
-func (r *runtime) Run(ctx context.Context) {
+// newStore returns the store of the runtime and the Kubernetes client, which is nil unless it's
+// injected or an option requires it. The clients are only built from the kubeconfig if they
+// are needed and not injected.
+func newStore(opts connectorOptions) (Store, kubernetes.Interface, error) {
+	store := opts.store
+	kubeClient := opts.client.kubeClient
+	requireKube := opts.leaderElection != nil || opts.sharding != nil || opts.leaseNamespace != ""
+	var err error
+	if store != nil {
+		if store, err = storeWithFilter(store, opts.labelSelector); err != nil {
+			return nil, nil, err
+		}
+	} else if opts.client.vanusClient != nil {
+		store = NewInformerStore(opts.client.vanusClient, opts.labelSelector)
+	}
+	if store != nil && (kubeClient != nil || !requireKube) {
+		return store, kubeClient, nil
+	}
+
+	config, err := newConfig(opts.client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if store == nil {
+		store = NewInformerStore(config.VanusFactoryClient, opts.labelSelector)
+	}
+	return store, config.KubeFactoryClient, nil
+}
+
+func storeWithFilter(store Store, filter string) (Store, error) {
+	if filter == "" {
+		return store, nil
+	}
+	filterable, ok := store.(FilterableStore)
+	if !ok {
+		return nil, fmt.Errorf("store %T doesn't support filter", store)
+	}
+	return filterable.WithFilter(filter)
+}
+
+// Run begins runtime, it blocks until ctx is done. An error is returned if the runtime
+// failed to start, e.g. the API server is unreachable or the caches failed to sync.
+func (r *runtime) Run(ctx context.Context) error {
 	defer utilruntime.HandleCrash()
+
+	r.storeLock.Lock()
+	if r.started {
+		r.storeLock.Unlock()
+		return errors.New("runtime is already running")
+	}
+	r.started = true
+	r.storeLock.Unlock()
+	defer r.metrics.delete()
 	defer r.shutdown()
+	// stop everything started in the background whichever way Run returns
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	log.Info("Starting controller manager")
 	defer log.Info("Shutting down controller manager")
 
+	if err := r.start(ctx); err != nil {
+		log.Errorf("failed to start runtime: %+v", err)
+		r.markFailed(err)
+		return err
+	}
+	if r.metricsAddr != "" {
+		go serveMetrics(ctx, r.metricsAddr)
+	}
+	if r.healthProbeAddr != "" {
+		go r.serveHealthProbes(ctx, r.healthProbeAddr)
+	}
+	handlerCtx, cancelHandlers := ctx, context.CancelFunc(nil)
+	if r.drainTimeout > 0 {
+		// the in-flight handler invocations are drained once ctx is done, they are only
+		// canceled once the drain timeout expires
+		handlerCtx, cancelHandlers = context.WithCancel(context.Background())
+		defer cancelHandlers()
+	}
+	r.startWorkers(ctx, handlerCtx)
+	r.markReady()
+	<-ctx.Done()
+	log.Info("Shutting down workers")
+	if r.drainTimeout > 0 {
+		r.gracefulShutdown(cancelHandlers)
+	}
+	return nil
+}
+
+// start waits for the caches to sync and lists the orphan connectors of the handler, the
+// startup is bounded by the startup timeout if it's set. Nothing is left running in the
+// background if it fails.
+func (r *runtime) start(ctx context.Context) error {
+	startupCtx := ctx
+	if r.startupTimeout > 0 {
+		var cancel context.CancelFunc
+		startupCtx, cancel = context.WithTimeout(ctx, r.startupTimeout)
+		defer cancel()
+	}
+
 	// Wait for the caches to be synced before starting workers
-	r.vanusInformerFactory.Start(ctx.Done())
+	store := r.currentStore()
+	if err := store.Start(startupCtx); err != nil {
+		return err
+	}
 
-	log.Info("Waiting for informer caches to sync")
+	log.Info("Waiting for store caches to sync")
 	cacheSyncs := []cache.InformerSynced{
-		r.connectorSynced,
+		store.HasSynced,
 	}
+	if ok := cache.WaitForCacheSync(startupCtx.Done(), cacheSyncs...); !ok {
+		return fmt.Errorf("failed to wait for caches to sync: %w", startupCtx.Err())
+	}
+	r.metrics.synced.Set(1)
 
-	if ok := cache.WaitForCacheSync(ctx.Done(), cacheSyncs...); !ok {
-		log.Fatal("failed to wait for caches to sync")
+	if r.leaderElection != nil {
+		// the orphans are listed once elected
+		return nil
+	}
+	if err := r.enqueueOrphanConnectors(startupCtx); err != nil {
+		return fmt.Errorf("failed to list active connectors of handler: %w", err)
 	}
+	return nil
+}
 
-	// start workers to do all the connectors operations
-	r.startWorkers(ctx)
-	<-ctx.Done()
-	log.Info("Shutting down workers")
+// Idle returns true if no connector is being synced or waiting in the queue, the connectors
+// waiting for a retry or requeue are not counted. It's used by runtimetest to step the fake
+// clock once the runtime has settled.
+func (r *runtime) Idle() bool {
+	return r.connectorQueue.Len() == 0 && r.syncing.Load() == 0
 }
 
 func (r *runtime) Lister() vanuslister.ConnectorLister {
-	return r.connectorsLister
+	return runtimeLister{r: r}
+}
+
+// ReportStatus reports the health of a running connector into its status.
+func (r *runtime) ReportStatus(connectorID string, state ConnectorState, message string) error {
+	return r.reporter.ReportStatus(connectorID, state, message)
 }
 
-func (r *runtime) startWorkers(ctx context.Context) {
-	log.Info("Starting workers")
+// startWorkers starts the workers to do all the connectors operations, the workers run until
+// ctx is done and invoke the handler with handlerCtx.
+func (r *runtime) startWorkers(ctx, handlerCtx context.Context) {
+	log.Infof("Starting %d workers", r.workerCount)
 
-	go wait.Until(r.runAddConnectorWorker, time.Second, ctx.Done())
-	go wait.Until(r.runUpdateConnectorWorker, time.Second, ctx.Done())
-	go wait.Until(r.runDeleteConnectorWorker, time.Second, ctx.Done())
+	r.goWorker(func() { wait.UntilWithContext(ctx, r.reporter.run, time.Second) })
+	if r.sharder != nil {
+		r.goWorker(func() { r.sharder.run(ctx) })
+	}
+	if r.leases != nil {
+		r.goWorker(func() { r.leases.run(ctx) })
+	}
+	if r.leaderElection != nil {
+		// the connector worker is started once elected
+		r.goWorker(func() { r.runLeaderElection(ctx, handlerCtx) })
+		return
+	}
+	r.startConnectorWorkers(ctx, handlerCtx)
 }
 
-func (r *runtime) shutdown() {
-	r.addConnectorQueue.ShutDown()
-	r.updateConnectorQueue.ShutDown()
-	r.deleteConnectorQueue.ShutDown()
+// startConnectorWorkers starts the connector workers, the queue never hands out a key to two
+// workers at the same time, so a connector is never synced concurrently.
+func (r *runtime) startConnectorWorkers(ctx, handlerCtx context.Context) {
+	for i := 0; i < r.workerCount; i++ {
+		r.goWorker(func() {
+			wait.UntilWithContext(ctx, func(ctx context.Context) { r.runConnectorWorker(ctx, handlerCtx) }, time.Second)
+		})
+	}
 }
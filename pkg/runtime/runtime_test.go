@@ -0,0 +1,99 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+// failingLister is a handler which fails to list its active connectors.
+type failingLister struct {
+	runtime.ConnectorHandlerFuncs
+	err error
+}
+
+func (h failingLister) ActiveConnectors(context.Context) ([]string, error) {
+	return nil, h.err
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+func TestRunStartupFailure(t *testing.T) {
+	boom := errors.New("boom")
+	addr := freeAddr(t)
+	r, err := runtime.New(
+		runtime.WithStore(runtimetest.NewStore()),
+		runtime.WithHandler(failingLister{err: boom}),
+		runtime.WithHealthProbeAddress(addr),
+	)
+	if err != nil {
+		t.Fatalf("failed to create runtime: %v", err)
+	}
+
+	// ctx is never canceled, Run must not leave anything running behind
+	if err = r.Run(context.Background()); !errors.Is(err, boom) {
+		t.Fatalf("unexpected error of Run: %v", err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 200*time.Millisecond, func() (bool, error) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false, nil
+		}
+		_ = conn.Close()
+		return true, nil
+	})
+	if err == nil {
+		t.Fatal("health probes are served after Run failed")
+	}
+}
+
+func TestWaitForReadyStartupFailure(t *testing.T) {
+	boom := errors.New("boom")
+	r, err := runtime.New(
+		runtime.WithStore(runtimetest.NewStore()),
+		runtime.WithHandler(failingLister{err: boom}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create runtime: %v", err)
+	}
+	go func() {
+		_ = r.Run(context.Background())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = r.WaitForReady(ctx); !errors.Is(err, boom) {
+		t.Fatalf("unexpected error of WaitForReady: %v", err)
+	}
+}
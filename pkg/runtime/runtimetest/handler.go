@@ -0,0 +1,191 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtimetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/utils/clock"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+)
+
+// EventType is the type of a handler invocation.
+type EventType string
+
+const (
+	EventAdd    EventType = "Add"
+	EventUpdate EventType = "Update"
+	EventDelete EventType = "Delete"
+	// EventStop is recorded if the handler implements runtime.ConnectorStopper.
+	EventStop EventType = "Stop"
+)
+
+// Event is a handler invocation observed by the harness.
+type Event struct {
+	Type        EventType
+	ConnectorID string
+	// Generation is the generation of the connector passed to the handler, it's 0 for stops.
+	Generation int64
+	// Time is the time of the fake clock when the handler was invoked.
+	Time time.Time
+	// Err is the error returned by the handler or injected by FailNext.
+	Err error
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s(%s", e.Type, e.ConnectorID)
+	if e.Generation != 0 {
+		s += fmt.Sprintf(", generation=%d", e.Generation)
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(", err=%q", e.Err.Error())
+	}
+	return s + ")"
+}
+
+// failure is an error injected into the handler invocations matching its type and connector.
+type failure struct {
+	typ         EventType
+	connectorID string
+	times       int
+	err         error
+}
+
+// recorder records the invocations of the handler under test, the optional interfaces of
+// the handler are kept.
+type recorder struct {
+	handler runtime.ConnectorHandler
+	clock   clock.PassiveClock
+
+	mu       sync.Mutex
+	events   []Event
+	failures []*failure
+}
+
+func newRecorder(handler runtime.ConnectorHandler, clock clock.PassiveClock) *recorder {
+	return &recorder{handler: handler, clock: clock}
+}
+
+func (r *recorder) OnAdd(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+	return r.invoke(EventAdd, connector.Name, connector.Generation, func() error {
+		return r.handler.OnAdd(ctx, connector)
+	})
+}
+
+func (r *recorder) OnUpdate(ctx context.Context, old, new *vanusv1alpha1.Connector) error {
+	return r.invoke(EventUpdate, new.Name, new.Generation, func() error {
+		return r.handler.OnUpdate(ctx, old, new)
+	})
+}
+
+func (r *recorder) OnDelete(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+	return r.invoke(EventDelete, connector.Name, connector.Generation, func() error {
+		return r.handler.OnDelete(ctx, connector)
+	})
+}
+
+// InjectStatusReporter injects the reporter into the handler if it wants one.
+func (r *recorder) InjectStatusReporter(reporter runtime.StatusReporter) {
+	if injector, ok := r.handler.(runtime.StatusReporterInjector); ok {
+		injector.InjectStatusReporter(reporter)
+	}
+}
+
+// ActiveConnectors lists the connectors of the handler if it knows them.
+func (r *recorder) ActiveConnectors(ctx context.Context) ([]string, error) {
+	if activeLister, ok := r.handler.(runtime.ActiveConnectorLister); ok {
+		return activeLister.ActiveConnectors(ctx)
+	}
+	return nil, nil
+}
+
+// OnStop stops the connector of the handler if it supports it.
+func (r *recorder) OnStop(ctx context.Context, connectorID string) error {
+	stopper, ok := r.handler.(runtime.ConnectorStopper)
+	if !ok {
+		return nil
+	}
+	return r.invoke(EventStop, connectorID, 0, func() error {
+		return stopper.OnStop(ctx, connectorID)
+	})
+}
+
+// invoke calls fn unless a failure is injected, and records the invocation.
+func (r *recorder) invoke(typ EventType, connectorID string, generation int64, fn func() error) error {
+	event := Event{
+		Type:        typ,
+		ConnectorID: connectorID,
+		Generation:  generation,
+		Time:        r.clock.Now(),
+	}
+	if event.Err = r.injectedFailure(typ, connectorID); event.Err == nil {
+		event.Err = fn()
+	}
+	r.mu.Lock()
+	r.events = append(r.events, event)
+	r.mu.Unlock()
+	return event.Err
+}
+
+func (r *recorder) failNext(typ EventType, connectorID string, times int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = append(r.failures, &failure{typ: typ, connectorID: connectorID, times: times, err: err})
+}
+
+func (r *recorder) injectedFailure(typ EventType, connectorID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, f := range r.failures {
+		if f.typ != typ || (f.connectorID != "" && f.connectorID != connectorID) {
+			continue
+		}
+		f.times--
+		if f.times <= 0 {
+			r.failures = append(r.failures[:i], r.failures[i+1:]...)
+		}
+		return f.err
+	}
+	return nil
+}
+
+func (r *recorder) recorded() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// last returns the last invocation of the handler for the connector, excluding stops.
+func (r *recorder) last(connectorID string) (Event, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := len(r.events) - 1; i >= 0; i-- {
+		if r.events[i].ConnectorID == connectorID && r.events[i].Type != EventStop {
+			return r.events[i], true
+		}
+	}
+	return Event{}, false
+}
+
+func (r *recorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = nil
+}
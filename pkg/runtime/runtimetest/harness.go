@@ -0,0 +1,282 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package runtimetest runs a connector handler against an in-memory runtime, so handlers can
+// be unit-tested with the real semantics of the runtime: ordering, retries, finalizers and
+// status reporting. The time of the runtime is faked, retries only happen when the clock is
+// stepped.
+//
+//	h := runtimetest.New(t, runtime.AdaptEventHandler(handler))
+//	h.FailNext(runtimetest.EventAdd, "chatgpt", 1, errors.New("boom"))
+//	h.Create(connector)
+//	h.WaitForEvents(1)
+//	h.Step(5 * time.Millisecond)
+//	h.WaitForObserved("chatgpt")
+//	h.ExpectEvents(
+//		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "chatgpt"},
+//		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "chatgpt"},
+//	)
+package runtimetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+)
+
+const (
+	// DefaultTimeout is how long the harness waits for the runtime in real time.
+	DefaultTimeout = 10 * time.Second
+	pollInterval   = 5 * time.Millisecond
+)
+
+// idler is implemented by the runtime to tell whether it has settled.
+type idler interface {
+	Idle() bool
+}
+
+// Harness runs a handler against an in-memory runtime. The methods fail the test instead of
+// returning errors, and must be called from the goroutine running the test.
+type Harness struct {
+	t        testing.TB
+	store    *Store
+	clock    *clocktesting.FakeClock
+	runtime  runtime.Runtime
+	recorder *recorder
+	timeout  time.Duration
+}
+
+// New starts a runtime invoking handler and stops it when the test finishes. The options are
+// applied to the runtime after the in-memory store and the fake clock, the handler must not
+// be replaced by them, wrap a runtime.ConnectorEventHandler by runtime.AdaptEventHandler.
+func New(t testing.TB, handler runtime.ConnectorHandler, opts ...runtime.ConnectorOption) *Harness {
+	t.Helper()
+	h := &Harness{
+		t:       t,
+		store:   NewStore(),
+		clock:   clocktesting.NewFakeClock(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)),
+		timeout: DefaultTimeout,
+	}
+	h.store.SetClock(h.clock)
+	h.recorder = newRecorder(handler, h.clock)
+
+	opts = append([]runtime.ConnectorOption{
+		runtime.WithStore(h.store),
+		runtime.WithClock(h.clock),
+	}, opts...)
+	opts = append(opts, runtime.WithHandler(h.recorder))
+	r, err := runtime.New(opts...)
+	if err != nil {
+		t.Fatalf("failed to create runtime: %v", err)
+	}
+	h.runtime = r
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("runtime failed: %v", err)
+			}
+		case <-time.After(h.timeout):
+			t.Errorf("timeout waiting for runtime to stop")
+		}
+	})
+
+	readyCtx, readyCancel := context.WithTimeout(ctx, h.timeout)
+	defer readyCancel()
+	if err = r.WaitForReady(readyCtx); err != nil {
+		select {
+		case err = <-done:
+		default:
+		}
+		t.Fatalf("runtime is not ready: %v", err)
+	}
+	return h
+}
+
+// Runtime returns the runtime under test.
+func (h *Harness) Runtime() runtime.Runtime {
+	return h.runtime
+}
+
+// Store returns the in-memory store of the runtime.
+func (h *Harness) Store() *Store {
+	return h.store
+}
+
+// Clock returns the fake clock of the runtime.
+func (h *Harness) Clock() *clocktesting.FakeClock {
+	return h.clock
+}
+
+// Create creates the connector and returns the stored one.
+func (h *Harness) Create(connector *vanusv1alpha1.Connector) *vanusv1alpha1.Connector {
+	h.t.Helper()
+	created, err := h.store.Create(context.Background(), connector)
+	if err != nil {
+		h.t.Fatalf("failed to create connector %s: %v", connector.Name, err)
+	}
+	return created
+}
+
+// Update updates the connector except its status and returns the stored one, the update is
+// unconditional if the resource version of connector is empty.
+func (h *Harness) Update(connector *vanusv1alpha1.Connector) *vanusv1alpha1.Connector {
+	h.t.Helper()
+	updated, err := h.store.Update(context.Background(), connector)
+	if err != nil {
+		h.t.Fatalf("failed to update connector %s: %v", connector.Name, err)
+	}
+	return updated
+}
+
+// Delete deletes the connector.
+func (h *Harness) Delete(name string) {
+	h.t.Helper()
+	if err := h.store.Delete(context.Background(), name); err != nil {
+		h.t.Fatalf("failed to delete connector %s: %v", name, err)
+	}
+}
+
+// Get returns the stored connector including the status written by the runtime, or nil if
+// it doesn't exist.
+func (h *Harness) Get(name string) *vanusv1alpha1.Connector {
+	h.t.Helper()
+	connector, err := h.store.Get(context.Background(), name)
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		h.t.Fatalf("failed to get connector %s: %v", name, err)
+	}
+	return connector
+}
+
+// FailNext makes the next times invocations of the given type return err instead of calling
+// the handler, connectorID "" matches all the connectors.
+func (h *Harness) FailNext(typ EventType, connectorID string, times int, err error) {
+	h.recorder.failNext(typ, connectorID, times, err)
+}
+
+// Events returns the handler invocations observed so far.
+func (h *Harness) Events() []Event {
+	return h.recorder.recorded()
+}
+
+// ResetEvents forgets the handler invocations observed so far.
+func (h *Harness) ResetEvents() {
+	h.recorder.reset()
+}
+
+// ExpectEvents fails the test unless the handler invocations observed so far are exactly
+// want. The zero fields of want are not compared, except Type and ConnectorID, and Err
+// matches by errors.Is.
+func (h *Harness) ExpectEvents(want ...Event) {
+	h.t.Helper()
+	got := h.Events()
+	match := len(got) == len(want)
+	for i := 0; match && i < len(want); i++ {
+		match = eventMatches(got[i], want[i])
+	}
+	if !match {
+		h.t.Fatalf("unexpected handler invocations\ngot:  %s\nwant: %s", formatEvents(got), formatEvents(want))
+	}
+}
+
+func eventMatches(got, want Event) bool {
+	return got.Type == want.Type &&
+		got.ConnectorID == want.ConnectorID &&
+		(want.Generation == 0 || got.Generation == want.Generation) &&
+		(want.Time.IsZero() || got.Time.Equal(want.Time)) &&
+		(want.Err == nil || errors.Is(got.Err, want.Err))
+}
+
+func formatEvents(events []Event) string {
+	s := make([]string, 0, len(events))
+	for _, event := range events {
+		s = append(s, event.String())
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+// WaitForEvents waits until the handler has been invoked at least n times and returns the
+// invocations.
+func (h *Harness) WaitForEvents(n int) []Event {
+	h.t.Helper()
+	h.waitFor(fmt.Sprintf("%d handler invocations", n), func() bool {
+		return len(h.recorder.recorded()) >= n
+	})
+	return h.Events()
+}
+
+// WaitForObserved waits until the handler has been invoked with the current generation of
+// the connector, or with OnDelete if it's deleted or deleting, whether the invocation
+// succeeded or not. A connector the runtime ignores, e.g. one filtered out, is never
+// observed.
+func (h *Harness) WaitForObserved(name string) {
+	h.t.Helper()
+	h.waitFor(fmt.Sprintf("connector %s to be observed", name), func() bool {
+		connector, err := h.store.Get(context.Background(), name)
+		last, invoked := h.recorder.last(name)
+		if err != nil || connector.DeletionTimestamp != nil {
+			return !invoked || last.Type == EventDelete
+		}
+		return invoked && last.Type != EventDelete && last.Generation >= connector.Generation
+	})
+}
+
+// WaitForIdle waits until the runtime has no connector to sync, except those waiting for
+// the clock to reach their retry.
+func (h *Harness) WaitForIdle() {
+	h.t.Helper()
+	idle, ok := h.runtime.(idler)
+	if !ok {
+		h.t.Fatalf("runtime %T can't tell whether it's idle", h.runtime)
+	}
+	h.waitFor("runtime to be idle", idle.Idle)
+}
+
+// Step waits for the runtime to be idle and then advances the fake clock by d, the
+// connectors whose retry is due are synced afterwards.
+func (h *Harness) Step(d time.Duration) {
+	h.t.Helper()
+	h.WaitForIdle()
+	h.clock.Step(d)
+}
+
+func (h *Harness) waitFor(what string, condition func() bool) {
+	h.t.Helper()
+	err := wait.PollImmediate(pollInterval, h.timeout, func() (bool, error) {
+		return condition(), nil
+	})
+	if err != nil {
+		h.t.Fatalf("timeout waiting for %s, handler invocations: %s", what, formatEvents(h.Events()))
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtimetest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+func newConnector(name string) *vanusv1alpha1.Connector {
+	return &vanusv1alpha1.Connector{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       vanusv1alpha1.ConnectorSpec{Kind: "source", Type: "chatgpt"},
+	}
+}
+
+func TestHarnessLifecycle(t *testing.T) {
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{})
+
+	h.Create(newConnector("a"))
+	h.WaitForObserved("a")
+	connector := h.Get("a")
+	connector.Spec.Config = "key: value"
+	h.Update(connector)
+	h.WaitForObserved("a")
+	h.Delete("a")
+	h.WaitForObserved("a")
+
+	h.ExpectEvents(
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a", Generation: 1},
+		runtimetest.Event{Type: runtimetest.EventUpdate, ConnectorID: "a", Generation: 2},
+		runtimetest.Event{Type: runtimetest.EventDelete, ConnectorID: "a", Generation: 2},
+	)
+}
+
+func TestHarnessStatus(t *testing.T) {
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{})
+
+	h.Create(newConnector("a"))
+	h.WaitForObserved("a")
+	h.WaitForIdle()
+	status := h.Get("a").Status
+	if status.Phase != vanusv1alpha1.ConnectorRunning || status.ObservedGeneration != 1 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
+
+func TestHarnessRetryTiming(t *testing.T) {
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{})
+	boom := errors.New("boom")
+	start := h.Clock().Now()
+
+	h.FailNext(runtimetest.EventAdd, "a", 2, boom)
+	h.Create(newConnector("a"))
+	h.WaitForEvents(1)
+	// the retry is not due before the base delay of the default policy
+	h.Step(4 * time.Millisecond)
+	h.WaitForIdle()
+	if n := len(h.Events()); n != 1 {
+		t.Fatalf("retried before the backoff elapsed, %d invocations", n)
+	}
+	h.Step(time.Millisecond)
+	h.WaitForEvents(2)
+	// the delay doubles
+	h.Step(10 * time.Millisecond)
+	h.WaitForEvents(3)
+	h.WaitForIdle()
+
+	h.ExpectEvents(
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a", Time: start, Err: boom},
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a", Time: start.Add(5 * time.Millisecond), Err: boom},
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a", Time: start.Add(15 * time.Millisecond)},
+	)
+	if err := h.Events()[2].Err; err != nil {
+		t.Fatalf("unexpected error of the last invocation: %v", err)
+	}
+	if phase := h.Get("a").Status.Phase; phase != vanusv1alpha1.ConnectorRunning {
+		t.Fatalf("unexpected phase %s", phase)
+	}
+}
+
+func TestHarnessFinalizer(t *testing.T) {
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{}, runtime.WithFinalizer(""))
+	boom := errors.New("boom")
+
+	h.Create(newConnector("a"))
+	h.WaitForObserved("a")
+	h.WaitForIdle()
+	if finalizers := h.Get("a").Finalizers; len(finalizers) != 1 || finalizers[0] != runtime.DefaultFinalizer {
+		t.Fatalf("unexpected finalizers %v", finalizers)
+	}
+
+	// the finalizer is kept until the handler deleted the connector
+	h.FailNext(runtimetest.EventDelete, "a", 1, boom)
+	h.Delete("a")
+	h.WaitForEvents(2)
+	h.WaitForIdle()
+	connector := h.Get("a")
+	if connector == nil || connector.DeletionTimestamp == nil {
+		t.Fatalf("connector is deleted before the handler deleted it: %+v", connector)
+	}
+	if connector.Status.Phase != vanusv1alpha1.ConnectorDeleting {
+		t.Fatalf("unexpected phase %s", connector.Status.Phase)
+	}
+	h.Step(5 * time.Millisecond)
+	h.WaitForEvents(3)
+	h.WaitForIdle()
+	if connector = h.Get("a"); connector != nil {
+		t.Fatalf("connector is not deleted: %+v", connector)
+	}
+	h.ExpectEvents(
+		runtimetest.Event{Type: runtimetest.EventAdd, ConnectorID: "a"},
+		runtimetest.Event{Type: runtimetest.EventDelete, ConnectorID: "a", Err: boom},
+		runtimetest.Event{Type: runtimetest.EventDelete, ConnectorID: "a"},
+	)
+}
+
+func TestHarnessStoreConflict(t *testing.T) {
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{})
+
+	stale := h.Create(newConnector("a"))
+	h.WaitForObserved("a")
+	h.WaitForIdle()
+	// the status has been written since
+	stale.Spec.Config = "key: value"
+	if _, err := h.Store().Update(context.Background(), stale); err == nil {
+		t.Fatal("expected a conflict updating a stale connector")
+	}
+}
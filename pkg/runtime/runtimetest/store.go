@@ -0,0 +1,294 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtimetest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/clock"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	vanuslister "github.com/vanus-labs/vanus-connect-runtime/pkg/client/listers/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+)
+
+var connectorResource = vanusv1alpha1.Resource("connectors")
+
+// Store is an in-memory runtime.Store following the semantics of the API server: the
+// generation is bumped on spec changes, writes with a stale resource version conflict and a
+// connector with finalizers is only marked deleting until its finalizers are removed.
+//
+// The events are delivered synchronously, so a connector is queued by the runtime once
+// Create, Update or Delete returns.
+type Store struct {
+	backend  *backend
+	selector labels.Selector
+	indexer  cache.Indexer
+	lister   vanuslister.ConnectorLister
+
+	// handlers and started are guarded by the lock of backend
+	handlers []cache.ResourceEventHandler
+	started  bool
+}
+
+var _ runtime.FilterableStore = &Store{}
+
+// backend holds the connectors shared by the stores created by WithFilter.
+type backend struct {
+	clock clock.PassiveClock
+
+	mu              sync.Mutex
+	connectors      map[string]*vanusv1alpha1.Connector
+	stores          []*Store
+	resourceVersion uint64
+}
+
+// NewStore returns an empty in-memory store.
+func NewStore() *Store {
+	return newStore(&backend{
+		clock:      clock.RealClock{},
+		connectors: map[string]*vanusv1alpha1.Connector{},
+	}, labels.Everything())
+}
+
+func newStore(b *backend, selector labels.Selector) *Store {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	return &Store{
+		backend:  b,
+		selector: selector,
+		indexer:  indexer,
+		lister:   vanuslister.NewConnectorLister(indexer),
+	}
+}
+
+// SetClock sets the clock of the creation and deletion timestamps.
+func (s *Store) SetClock(clock clock.PassiveClock) {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	s.backend.clock = clock
+}
+
+func (s *Store) AddEventHandler(handler cache.ResourceEventHandler) error {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	s.handlers = append(s.handlers, handler)
+	return nil
+}
+
+func (s *Store) Start(_ context.Context) error {
+	b := s.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s.started {
+		return errors.New("store is already started")
+	}
+	s.started = true
+	b.stores = append(b.stores, s)
+	for _, connector := range b.connectors {
+		s.notify(nil, connector)
+	}
+	return nil
+}
+
+func (s *Store) Stop() {
+	b := s.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, store := range b.stores {
+		if store == s {
+			b.stores = append(b.stores[:i], b.stores[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *Store) HasSynced() bool {
+	s.backend.mu.Lock()
+	defer s.backend.mu.Unlock()
+	return s.started
+}
+
+func (s *Store) Lister() vanuslister.ConnectorLister {
+	return s.lister
+}
+
+func (s *Store) WithFilter(filter string) (runtime.Store, error) {
+	selector, err := labels.Parse(filter)
+	if err != nil {
+		return nil, err
+	}
+	return newStore(s.backend, selector), nil
+}
+
+// Get gets the connector, the selector of the store is not applied.
+func (s *Store) Get(_ context.Context, name string) (*vanusv1alpha1.Connector, error) {
+	b := s.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	connector, ok := b.connectors[name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(connectorResource, name)
+	}
+	return connector.DeepCopy(), nil
+}
+
+// Create creates the connector, its status is kept.
+func (s *Store) Create(_ context.Context, connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error) {
+	b := s.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if connector.Name == "" {
+		return nil, k8serrors.NewBadRequest("connector name is required")
+	}
+	if _, ok := b.connectors[connector.Name]; ok {
+		return nil, k8serrors.NewAlreadyExists(connectorResource, connector.Name)
+	}
+	newConnector := connector.DeepCopy()
+	newConnector.UID = uuid.NewUUID()
+	newConnector.Generation = 1
+	newConnector.CreationTimestamp = metav1.NewTime(b.clock.Now())
+	newConnector.DeletionTimestamp = nil
+	b.store(nil, newConnector)
+	return newConnector.DeepCopy(), nil
+}
+
+// Update updates the connector except its status. The update is unconditional if the
+// resource version of connector is empty.
+func (s *Store) Update(_ context.Context, connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error) {
+	b := s.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, err := b.current(connector)
+	if err != nil {
+		return nil, err
+	}
+	newConnector := old.DeepCopy()
+	newConnector.Labels = connector.Labels
+	newConnector.Annotations = connector.Annotations
+	newConnector.Finalizers = connector.Finalizers
+	if !equality.Semantic.DeepEqual(old.Spec, connector.Spec) {
+		newConnector.Spec = connector.Spec
+		newConnector.Generation++
+	}
+	if newConnector.DeletionTimestamp != nil && len(newConnector.Finalizers) == 0 {
+		b.remove(old)
+		return newConnector, nil
+	}
+	if equality.Semantic.DeepEqual(old, newConnector) {
+		return newConnector, nil
+	}
+	b.store(old, newConnector)
+	return newConnector.DeepCopy(), nil
+}
+
+// UpdateStatus updates the status of the connector. The update is unconditional if the
+// resource version of connector is empty.
+func (s *Store) UpdateStatus(_ context.Context, connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error) {
+	b := s.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, err := b.current(connector)
+	if err != nil {
+		return nil, err
+	}
+	newConnector := old.DeepCopy()
+	connector.Status.DeepCopyInto(&newConnector.Status)
+	b.store(old, newConnector)
+	return newConnector.DeepCopy(), nil
+}
+
+// Delete deletes the connector, it's only marked deleting if it has finalizers.
+func (s *Store) Delete(_ context.Context, name string) error {
+	b := s.backend
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old, ok := b.connectors[name]
+	if !ok {
+		return k8serrors.NewNotFound(connectorResource, name)
+	}
+	if len(old.Finalizers) == 0 {
+		b.remove(old)
+		return nil
+	}
+	if old.DeletionTimestamp != nil {
+		return nil
+	}
+	newConnector := old.DeepCopy()
+	now := metav1.NewTime(b.clock.Now())
+	newConnector.DeletionTimestamp = &now
+	b.store(old, newConnector)
+	return nil
+}
+
+// current returns the stored connector, or an error if connector is stale.
+func (b *backend) current(connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error) {
+	old, ok := b.connectors[connector.Name]
+	if !ok {
+		return nil, k8serrors.NewNotFound(connectorResource, connector.Name)
+	}
+	if connector.ResourceVersion != "" && connector.ResourceVersion != old.ResourceVersion {
+		return nil, k8serrors.NewConflict(connectorResource, connector.Name,
+			errors.New("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+	return old, nil
+}
+
+func (b *backend) store(old, connector *vanusv1alpha1.Connector) {
+	b.resourceVersion++
+	connector.ResourceVersion = strconv.FormatUint(b.resourceVersion, 10)
+	b.connectors[connector.Name] = connector
+	for _, s := range b.stores {
+		s.notify(old, connector)
+	}
+}
+
+func (b *backend) remove(old *vanusv1alpha1.Connector) {
+	delete(b.connectors, old.Name)
+	for _, s := range b.stores {
+		s.notify(old, nil)
+	}
+}
+
+// notify delivers the change of a connector to the handlers of the store, the connectors not
+// matching the selector of the store are invisible to them.
+func (s *Store) notify(old, connector *vanusv1alpha1.Connector) {
+	oldMatched := old != nil && s.selector.Matches(labels.Set(old.Labels))
+	matched := connector != nil && s.selector.Matches(labels.Set(connector.Labels))
+	switch {
+	case matched:
+		_ = s.indexer.Update(connector)
+	case oldMatched:
+		_ = s.indexer.Delete(old)
+	}
+	for _, handler := range s.handlers {
+		switch {
+		case oldMatched && matched:
+			handler.OnUpdate(old, connector)
+		case oldMatched:
+			handler.OnDelete(old)
+		case matched:
+			handler.OnAdd(connector)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	log "k8s.io/klog/v2"
+)
+
+const (
+	// shardGroupLabel is the label of the member leases of a shard group.
+	shardGroupLabel = "vanus.ai/connect-runtime-shard"
+	// virtualNodes is the number of points of each member on the hash ring.
+	virtualNodes = 100
+)
+
+type shardingOptions struct {
+	group     string
+	namespace string
+	period    time.Duration
+}
+
+// sharder spreads the connectors over the replicas of a shard group by consistent hashing of
+// the connector name. Every replica holds a member lease which it renews periodically, the
+// live leases of the group make up the hash ring.
+//
+// When the members change, a replica gives up the connectors it no longer owns immediately
+// but only acquires new ones after a handoff period, during which it owns a connector only if
+// it does under all the rings since the last settled one. The period is long enough for every
+// other replica to notice the change and release the connector, so a connector never runs on
+// two replicas at the same time. The expired member leases are deleted by the members.
+type sharder struct {
+	r        *runtime
+	opts     shardingOptions
+	member   string
+	clock    func() time.Time
+	duration time.Duration
+	deadline time.Duration
+	period   time.Duration
+	// syncLock serializes sync
+	syncLock sync.Mutex
+
+	mu        sync.RWMutex
+	lastRenew time.Time
+	current   *hashRing
+	// previous is the rings since the last settled one, they are kept until the handoff is
+	// done so a change during the handoff doesn't give away the connectors of older rings
+	previous     []*hashRing
+	handoffUntil time.Time
+	handoffDone  bool
+}
+
+func newSharder(r *runtime, opts shardingOptions) *sharder {
+	return &sharder{
+		r:        r,
+		opts:     opts,
+		member:   fmt.Sprintf("%s-%s", opts.group, uuid.NewUUID()),
+		clock:    r.clock.Now,
+		duration: defaultLeaseDuration,
+		deadline: defaultRenewDeadline,
+		period:   opts.period,
+		// a new member owns nothing until the handoff from the existing members is done
+		current: newHashRing(nil),
+	}
+}
+
+// owns returns true if the connector is owned by this replica.
+func (s *sharder) owns(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.clock().Sub(s.lastRenew) > s.deadline {
+		// the other members may consider this replica dead soon, give up everything
+		return false
+	}
+	if s.current.get(key) != s.member {
+		return false
+	}
+	if s.clock().Before(s.handoffUntil) {
+		for _, ring := range s.previous {
+			if ring.get(key) != s.member {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *sharder) run(ctx context.Context) {
+	if s.period > 0 {
+		wait.UntilWithContext(ctx, s.sync, s.period)
+	} else {
+		// the member lease is only synced on demand, e.g. in tests
+		<-ctx.Done()
+	}
+	// leave the group so the other members take over without waiting the lease to expire
+	err := s.leases().Delete(context.Background(), s.member, metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		log.Errorf("delete member lease %s failed: %+v", s.member, err)
+	}
+}
+
+// sync renews the member lease and refreshes the members of the group.
+func (s *sharder) sync(ctx context.Context) {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	wasHealthy := s.healthy()
+	if err := s.renew(ctx); err != nil {
+		log.Errorf("renew member lease %s failed: %+v", s.member, err)
+		if wasHealthy && !s.healthy() {
+			log.Errorf("member lease %s expired, releasing all connectors", s.member)
+			s.r.enqueueAppliedConnectors()
+		}
+		return
+	}
+
+	members, err := s.members(ctx)
+	if err != nil {
+		log.Errorf("list members of shard group %s failed: %+v", s.opts.group, err)
+		return
+	}
+
+	s.mu.Lock()
+	changed := !s.current.hasMembers(members)
+	if changed {
+		log.Infof("members of shard group %s changed: %v", s.opts.group, members)
+		s.previous = append(s.previous, s.current)
+		s.current = newHashRing(members)
+		s.handoffUntil = s.clock().Add(s.duration)
+		s.handoffDone = false
+	}
+	handoffDone := !s.handoffDone && !s.clock().Before(s.handoffUntil)
+	if handoffDone {
+		s.handoffDone = true
+		s.previous = nil
+	}
+	s.mu.Unlock()
+
+	if changed || handoffDone || !wasHealthy {
+		// release the connectors given up, and acquire the new ones once the handoff is done
+		if err = s.r.enqueueAllConnectors(); err != nil {
+			log.Errorf("failed to list connectors: %+v", err)
+		}
+		s.r.enqueueAppliedConnectors()
+	}
+}
+
+func (s *sharder) renew(ctx context.Context) error {
+	now := metav1.NewMicroTime(s.clock())
+	durationSeconds := int32(s.duration.Seconds())
+	lease, err := s.leases().Get(ctx, s.member, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.member,
+				Namespace: s.opts.namespace,
+				Labels:    map[string]string{shardGroupLabel: s.opts.group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.r.identity,
+				LeaseDurationSeconds: &durationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if _, err = s.leases().Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		s.markRenewed(now.Time)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.RenewTime = &now
+	lease.Spec.LeaseDurationSeconds = &durationSeconds
+	if _, err = s.leases().Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	s.markRenewed(now.Time)
+	return nil
+}
+
+// healthy returns true if the member lease has been renewed within the renew deadline.
+func (s *sharder) healthy() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.clock().Sub(s.lastRenew) <= s.deadline
+}
+
+func (s *sharder) markRenewed(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRenew = t
+}
+
+// members returns the sorted members of the group whose lease is not expired, the expired
+// leases are deleted.
+func (s *sharder) members(ctx context.Context) ([]string, error) {
+	leases, err := s.leases().List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", shardGroupLabel, s.opts.group),
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock()
+	members := make([]string, 0, len(leases.Items))
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		if !leaseExpired(lease, now) {
+			members = append(members, lease.Name)
+			continue
+		}
+		// the lease is kept if the member renewed it in the meantime
+		err = s.leases().Delete(ctx, lease.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &lease.ResourceVersion},
+		})
+		if err != nil && !k8serrors.IsNotFound(err) && !k8serrors.IsConflict(err) {
+			log.Errorf("delete expired member lease %s failed: %+v", lease.Name, err)
+		}
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func (s *sharder) leases() coordinationv1client.LeaseInterface {
+	return s.r.kubeClient.CoordinationV1().Leases(s.opts.namespace)
+}
+
+// hashRing is a consistent hash ring of the members of a shard group.
+type hashRing struct {
+	members []string
+	hashes  []uint64
+	owners  map[uint64]string
+}
+
+func newHashRing(members []string) *hashRing {
+	ring := &hashRing{
+		members: members,
+		owners:  make(map[uint64]string, len(members)*virtualNodes),
+	}
+	for _, member := range members {
+		for i := 0; i < virtualNodes; i++ {
+			h := hashKey(fmt.Sprintf("%s#%d", member, i))
+			ring.hashes = append(ring.hashes, h)
+			ring.owners[h] = member
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// get returns the member owning key, or empty if the ring has no member.
+func (ring *hashRing) get(key string) string {
+	if len(ring.hashes) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	idx := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	if idx == len(ring.hashes) {
+		idx = 0
+	}
+	return ring.owners[ring.hashes[idx]]
+}
+
+func (ring *hashRing) hasMembers(members []string) bool {
+	if len(ring.members) != len(members) {
+		return false
+	}
+	for i := range members {
+		if ring.members[i] != members[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
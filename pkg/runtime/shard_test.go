@@ -0,0 +1,140 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+const shardGroup = "group"
+
+// createMember creates the member lease of another replica renewed at renewed.
+func createMember(t *testing.T, kube *kubefake.Clientset, name string, renewed time.Time) {
+	t.Helper()
+	renewTime := metav1.NewMicroTime(renewed)
+	duration := int32(time.Hour.Seconds())
+	_, err := kube.CoordinationV1().Leases("default").Create(context.Background(), &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{"vanus.ai/connect-runtime-shard": shardGroup},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			RenewTime:            &renewTime,
+			LeaseDurationSeconds: &duration,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("failed to create member lease %s: %v", name, err)
+	}
+}
+
+func deleteMember(t *testing.T, kube *kubefake.Clientset, name string) {
+	t.Helper()
+	if err := kube.CoordinationV1().Leases("default").Delete(context.Background(), name, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete member lease %s: %v", name, err)
+	}
+}
+
+// connectorKeys are the keys whose ownership is checked, they are random so that they spread
+// over the hash ring.
+var connectorKeys = func() []string {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = string(uuid.NewUUID())
+	}
+	return keys
+}()
+
+func ownedKeys(r runtime.Runtime) map[string]bool {
+	owned := map[string]bool{}
+	for _, key := range connectorKeys {
+		if runtime.ShardOwns(r, key) {
+			owned[key] = true
+		}
+	}
+	return owned
+}
+
+func TestSharderDeletesExpiredMembers(t *testing.T) {
+	kube := kubefake.NewSimpleClientset()
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{},
+		runtime.WithKubeClient(kube), runtime.WithSharding(shardGroup, "default"), runtime.WithoutPeriodicSync())
+	createMember(t, kube, "alive", h.Clock().Now())
+	createMember(t, kube, "dead", h.Clock().Now().Add(-2*time.Hour))
+
+	runtime.SyncSharder(context.Background(), h.Runtime())
+	_, err := kube.CoordinationV1().Leases("default").Get(context.Background(), "dead", metav1.GetOptions{})
+	if !k8serrors.IsNotFound(err) {
+		t.Fatalf("expired member lease is not deleted: %v", err)
+	}
+	if _, err = kube.CoordinationV1().Leases("default").Get(context.Background(), "alive", metav1.GetOptions{}); err != nil {
+		t.Fatalf("failed to get member lease: %v", err)
+	}
+}
+
+func TestSharderHandoffAcrossChanges(t *testing.T) {
+	kube := kubefake.NewSimpleClientset()
+	h := runtimetest.New(t, runtime.ConnectorHandlerFuncs{},
+		runtime.WithKubeClient(kube), runtime.WithSharding(shardGroup, "default"), runtime.WithoutPeriodicSync())
+	ctx := context.Background()
+	r := h.Runtime()
+	settle := func() {
+		h.Clock().Step(time.Minute)
+		runtime.SyncSharder(ctx, r)
+	}
+
+	createMember(t, kube, "b", h.Clock().Now())
+	createMember(t, kube, "c", h.Clock().Now())
+	runtime.SyncSharder(ctx, r)
+	settle()
+	before := ownedKeys(r)
+
+	// c leaves and then b leaves before the handoff is done
+	deleteMember(t, kube, "c")
+	runtime.SyncSharder(ctx, r)
+	deleteMember(t, kube, "b")
+	runtime.SyncSharder(ctx, r)
+	during := ownedKeys(r)
+	settle()
+	after := ownedKeys(r)
+
+	acquired := 0
+	for key := range after {
+		if !before[key] {
+			acquired++
+		}
+	}
+	if acquired == 0 {
+		t.Fatal("no connector moved to the replica, the test is meaningless")
+	}
+	for key := range during {
+		if !before[key] || !after[key] {
+			t.Fatalf("connector %s is owned during the handoff, it's owned before: %t, after: %t",
+				key, before[key], after[key])
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"time"
+
+	log "k8s.io/klog/v2"
+)
+
+// goWorker runs f in a goroutine tracked by the runtime, a graceful shutdown waits for all of
+// them to exit.
+func (r *runtime) goWorker(f func()) {
+	r.workers.Add(1)
+	go func() {
+		defer r.workers.Done()
+		f()
+	}()
+}
+
+// shutdown stops the store and the queues, so the workers exit once their in-flight work
+// is done.
+func (r *runtime) shutdown() {
+	r.shutdownOnce.Do(func() {
+		r.storeLock.Lock()
+		r.stopped = true
+		r.store.Stop()
+		r.storeLock.Unlock()
+		r.connectorQueue.ShutDown()
+		r.reporter.shutdown()
+	})
+}
+
+// gracefulShutdown waits for the in-flight handler invocations and the workers to exit, then
+// stops all the running connectors if the handler supports it. The whole process is bounded
+// by the drain timeout, the in-flight invocations are canceled by cancelHandlers once it
+// expires and the connectors are still stopped.
+func (r *runtime) gracefulShutdown(cancelHandlers context.CancelFunc) {
+	log.Infof("Draining workers in %s", r.drainTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), r.drainTimeout)
+	defer cancel()
+
+	r.shutdown()
+	done := make(chan struct{})
+	go func() {
+		r.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-drainCtx.Done():
+		log.Warningf("timeout waiting for workers to exit after %s, canceling the in-flight handler invocations", r.drainTimeout)
+		cancelHandlers()
+	}
+
+	r.stopAllConnectors(drainCtx)
+}
+
+// stopAllConnectors tells the handler to stop all the connectors it is running, the
+// connectors are kept as applied, they are not deleted. Every connector is told to stop even
+// if ctx is done, so the handler can still stop it without waiting.
+func (r *runtime) stopAllConnectors(ctx context.Context) {
+	var stopper ConnectorStopper
+	var ok bool
+	if r.reconciler != nil {
+		stopper, ok = r.reconciler.(ConnectorStopper)
+	} else {
+		stopper, ok = r.handler.(ConnectorStopper)
+	}
+	if !ok {
+		return
+	}
+
+	r.appliedLock.RLock()
+	keys := make([]string, 0, len(r.applied))
+	for key := range r.applied {
+		keys = append(keys, key)
+	}
+	r.appliedLock.RUnlock()
+	for _, key := range keys {
+		start := time.Now()
+		if err := stopper.OnStop(ctx, key); err != nil {
+			log.Errorf("stop connector %s failed: %+v", key, err)
+			continue
+		}
+		log.Infof("stopped connector %s in %s", key, time.Since(start))
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+// drainHandler blocks adding connector "slow" until release is closed or its context is done,
+// and records the connectors stopped.
+type drainHandler struct {
+	runtime.ConnectorHandlerFuncs
+	started chan struct{}
+	release chan struct{}
+	addErr  chan error
+
+	mu      sync.Mutex
+	stopped []string
+}
+
+func newDrainHandler() *drainHandler {
+	h := &drainHandler{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		addErr:  make(chan error, 1),
+	}
+	h.AddFunc = func(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+		if connector.Name != "slow" {
+			return nil
+		}
+		close(h.started)
+		select {
+		case <-h.release:
+		case <-ctx.Done():
+		}
+		h.addErr <- ctx.Err()
+		return ctx.Err()
+	}
+	return h
+}
+
+func (h *drainHandler) OnStop(_ context.Context, connectorID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopped = append(h.stopped, connectorID)
+	return nil
+}
+
+func (h *drainHandler) stoppedConnectors() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stopped := append([]string(nil), h.stopped...)
+	sort.Strings(stopped)
+	return stopped
+}
+
+// startDraining runs a runtime with graceful shutdown, adds the connectors "fast" and "slow",
+// and cancels the runtime while "slow" is being added. The error of Run is sent to the
+// returned channel.
+func startDraining(t *testing.T, handler *drainHandler, drainTimeout time.Duration) <-chan error {
+	t.Helper()
+	store := runtimetest.NewStore()
+	r, err := runtime.New(
+		runtime.WithStore(store),
+		runtime.WithHandler(handler),
+		runtime.WithWorkers(2),
+		runtime.WithGracefulShutdown(drainTimeout),
+	)
+	if err != nil {
+		t.Fatalf("failed to create runtime: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+	if err = r.WaitForReady(ctx); err != nil {
+		t.Fatalf("runtime is not ready: %v", err)
+	}
+	for _, name := range []string{"fast", "slow"} {
+		connector := &vanusv1alpha1.Connector{}
+		connector.Name = name
+		if _, err = store.Create(ctx, connector); err != nil {
+			t.Fatalf("failed to create connector: %v", err)
+		}
+	}
+	<-handler.started
+	// wait for fast to be added by the other worker
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	return done
+}
+
+func TestGracefulShutdownDrains(t *testing.T) {
+	handler := newDrainHandler()
+	done := startDraining(t, handler, 5*time.Second)
+
+	// the in-flight invocation is not canceled while draining
+	select {
+	case err := <-handler.addErr:
+		t.Fatalf("in-flight invocation is canceled once the runtime is shutting down: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(handler.release)
+	if err := <-handler.addErr; err != nil {
+		t.Fatalf("in-flight invocation is canceled: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("runtime failed: %v", err)
+	}
+	if stopped := handler.stoppedConnectors(); len(stopped) != 2 || stopped[0] != "fast" || stopped[1] != "slow" {
+		t.Fatalf("unexpected stopped connectors %v", stopped)
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	handler := newDrainHandler()
+	done := startDraining(t, handler, 300*time.Millisecond)
+	canceled := time.Now()
+
+	// the in-flight invocation is canceled once the drain timeout expires
+	if err := <-handler.addErr; err == nil {
+		t.Fatal("in-flight invocation returned without being canceled")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("runtime failed: %v", err)
+	}
+	if elapsed := time.Since(canceled); elapsed < 250*time.Millisecond {
+		t.Fatalf("in-flight invocation is canceled before the drain timeout, after %s", elapsed)
+	}
+	// the connectors applied are still stopped
+	if stopped := handler.stoppedConnectors(); len(stopped) != 1 || stopped[0] != "fast" {
+		t.Fatalf("unexpected stopped connectors %v", stopped)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	log "k8s.io/klog/v2"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+)
+
+// ErrInvalidConfig can be wrapped by handlers to indicate that the connector config is
+// invalid, the runtime then reports the ConfigValid condition of the connector as false.
+var ErrInvalidConfig = errors.New("invalid connector config")
+
+const (
+	reasonStarted          = "Started"
+	reasonUpdated          = "Updated"
+	reasonAddFailed        = "AddFailed"
+	reasonUpdateFailed     = "UpdateFailed"
+	reasonReconciled       = "Reconciled"
+	reasonReconcileFailed  = "ReconcileFailed"
+	reasonConfigInvalid    = "ConfigInvalid"
+	reasonConfigValid      = "ConfigValid"
+	reasonUnknown          = "Unknown"
+	reasonHealthy          = "Healthy"
+	reasonPermanentError   = "PermanentError"
+	reasonRetriesExhausted = "RetriesExhausted"
+	reasonNoHandler        = "NoHandler"
+)
+
+// updateStatus applies mutate to the status of the connector identified by key and writes
+// it back through the status subresource, the write is skipped if nothing changed.
+func (r *runtime) updateStatus(ctx context.Context, key string, mutate func(status *vanusv1alpha1.ConnectorStatus)) error {
+	first := true
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var connector *vanusv1alpha1.Connector
+		var err error
+		if first {
+			// the cache is good enough for the first attempt, fetch the latest on conflict
+			first = false
+			connector, err = r.lister().Get(key)
+		} else {
+			connector, err = r.currentStore().Get(ctx, key)
+		}
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		newConnector := connector.DeepCopy()
+		mutate(&newConnector.Status)
+		r.metrics.phases.set(key, newConnector.Status.Phase)
+		if equality.Semantic.DeepEqual(connector.Status, newConnector.Status) {
+			return nil
+		}
+		_, err = r.currentStore().UpdateStatus(ctx, newConnector)
+		return err
+	})
+}
+
+// recordPending marks the connector as Pending before it's handed to the handler for the
+// first time.
+func (r *runtime) recordPending(ctx context.Context, key string) {
+	err := r.updateStatus(ctx, key, func(status *vanusv1alpha1.ConnectorStatus) {
+		if status.Phase == "" {
+			setPhase(status, vanusv1alpha1.ConnectorPending)
+		}
+	})
+	if err != nil {
+		log.Errorf("update status of connector %s failed: %+v", key, err)
+	}
+}
+
+// recordResult records the result of a handler invocation into the connector status.
+func (r *runtime) recordResult(ctx context.Context, key string, generation int64, reason string, handleErr error) {
+	err := r.updateStatus(ctx, key, func(status *vanusv1alpha1.ConnectorStatus) {
+		status.ObservedGeneration = generation
+		if handleErr == nil {
+			setPhase(status, vanusv1alpha1.ConnectorRunning)
+			status.LastError = ""
+			setCondition(status, vanusv1alpha1.ConnectorReady, metav1.ConditionTrue, reason, "")
+			setCondition(status, vanusv1alpha1.ConnectorConfigValid, metav1.ConditionTrue, reasonConfigValid, "")
+			setCondition(status, vanusv1alpha1.ConnectorDegraded, metav1.ConditionFalse, reasonHealthy, "")
+			return
+		}
+		setPhase(status, vanusv1alpha1.ConnectorFailed)
+		status.LastError = handleErr.Error()
+		setCondition(status, vanusv1alpha1.ConnectorReady, metav1.ConditionFalse, failureReason(reason, handleErr), handleErr.Error())
+		if errors.Is(handleErr, ErrInvalidConfig) {
+			setCondition(status, vanusv1alpha1.ConnectorConfigValid, metav1.ConditionFalse, reasonConfigInvalid, handleErr.Error())
+		} else {
+			setCondition(status, vanusv1alpha1.ConnectorConfigValid, metav1.ConditionUnknown, reasonUnknown, "")
+		}
+	})
+	if err != nil {
+		log.Errorf("update status of connector %s failed: %+v", key, err)
+	}
+}
+
+// recordGiveUp marks the connector as Failed once the runtime stopped retrying it.
+func (r *runtime) recordGiveUp(ctx context.Context, key, reason string, handleErr error) {
+	err := r.updateStatus(ctx, key, func(status *vanusv1alpha1.ConnectorStatus) {
+		setPhase(status, vanusv1alpha1.ConnectorFailed)
+		status.LastError = handleErr.Error()
+		setCondition(status, vanusv1alpha1.ConnectorReady, metav1.ConditionFalse, failureReason(reason, handleErr), handleErr.Error())
+	})
+	if err != nil {
+		log.Errorf("update status of connector %s failed: %+v", key, err)
+	}
+}
+
+// failureReason returns the reason of the Ready condition of a failed connector, the
+// connectors without a handler are reported explicitly.
+func failureReason(reason string, err error) string {
+	if errors.Is(err, ErrNoHandler) {
+		return reasonNoHandler
+	}
+	return reason
+}
+
+func setPhase(status *vanusv1alpha1.ConnectorStatus, phase vanusv1alpha1.ConnectorPhase) {
+	if status.Phase == phase {
+		return
+	}
+	status.Phase = phase
+	status.LastTransitionTime = metav1.Now()
+}
+
+func setCondition(status *vanusv1alpha1.ConnectorStatus, conditionType string, conditionStatus metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: status.ObservedGeneration,
+		Reason:             reason,
+		Message:            message,
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime/runtimetest"
+)
+
+func TestConnectorPendingBeforeAdd(t *testing.T) {
+	var h *runtimetest.Harness
+	phases := make(chan vanusv1alpha1.ConnectorPhase, 1)
+	h = runtimetest.New(t, runtime.ConnectorHandlerFuncs{
+		AddFunc: func(ctx context.Context, connector *vanusv1alpha1.Connector) error {
+			stored, err := h.Store().Get(ctx, connector.Name)
+			if err != nil {
+				return err
+			}
+			phases <- stored.Status.Phase
+			return nil
+		},
+	})
+
+	h.Create(newConnector("a", nil))
+	if phase := <-phases; phase != vanusv1alpha1.ConnectorPending {
+		t.Fatalf("unexpected phase %q while adding", phase)
+	}
+	h.WaitForObserved("a")
+	h.WaitForIdle()
+	if phase := h.Get("a").Status.Phase; phase != vanusv1alpha1.ConnectorRunning {
+		t.Fatalf("unexpected phase %s", phase)
+	}
+}
+
+// reportingHandler is a handler which is injected the StatusReporter.
+type reportingHandler struct {
+	runtime.ConnectorHandlerFuncs
+	reporter chan runtime.StatusReporter
+}
+
+func (h *reportingHandler) InjectStatusReporter(reporter runtime.StatusReporter) {
+	h.reporter <- reporter
+}
+
+func TestStatusReportsCoalesced(t *testing.T) {
+	handler := &reportingHandler{reporter: make(chan runtime.StatusReporter, 1)}
+	h := runtimetest.New(t, handler, runtime.WithStatusReportInterval(5*time.Second))
+	reporter := <-handler.reporter
+
+	h.Create(newConnector("a", nil))
+	h.WaitForObserved("a")
+	h.WaitForIdle()
+	// the first report is written at once
+	written := h.Get("a").ResourceVersion
+	if err := reporter.ReportStatus("a", runtime.StateDegraded, "first"); err != nil {
+		t.Fatalf("failed to report status: %v", err)
+	}
+	waitForStatusWrite(t, h, "a", written)
+	written = h.Get("a").ResourceVersion
+
+	// the reports within the interval are written once, with the latest state
+	for _, report := range []struct {
+		state   runtime.ConnectorState
+		message string
+	}{
+		{state: runtime.StateFailed, message: "failed"},
+		{state: runtime.StateDegraded, message: "degraded"},
+		{state: runtime.StateRunning, message: "latest"},
+	} {
+		if err := reporter.ReportStatus("a", report.state, report.message); err != nil {
+			t.Fatalf("failed to report status: %v", err)
+		}
+	}
+	h.Step(4 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if rv := h.Get("a").ResourceVersion; rv != written {
+		t.Fatalf("status is written before the interval elapsed")
+	}
+	h.Step(time.Second)
+	waitForStatusWrite(t, h, "a", written)
+	connector := h.Get("a")
+	h.Step(5 * time.Second)
+	time.Sleep(10 * time.Millisecond)
+	if rv := h.Get("a").ResourceVersion; rv != connector.ResourceVersion {
+		t.Fatalf("status is written more than once")
+	}
+	if connector.Status.Phase != vanusv1alpha1.ConnectorRunning {
+		t.Fatalf("unexpected phase %s", connector.Status.Phase)
+	}
+	ready := meta.FindStatusCondition(connector.Status.Conditions, vanusv1alpha1.ConnectorReady)
+	if ready == nil || ready.Message != "latest" {
+		t.Fatalf("the latest report is not written, Ready condition %+v", ready)
+	}
+	if degraded := meta.IsStatusConditionTrue(connector.Status.Conditions, vanusv1alpha1.ConnectorDegraded); degraded {
+		t.Fatal("the latest report is not written, connector is degraded")
+	}
+}
+
+// waitForStatusWrite waits for the connector to be written since the resource version.
+func waitForStatusWrite(t *testing.T, h *runtimetest.Harness, name, resourceVersion string) {
+	t.Helper()
+	deadline := time.Now().Add(runtimetest.DefaultTimeout)
+	for h.Get(name).ResourceVersion == resourceVersion {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for status to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	log "k8s.io/klog/v2"
+
+	vanusv1alpha1 "github.com/vanus-labs/vanus-connect-runtime/pkg/apis/vanus/v1alpha1"
+	vanuslister "github.com/vanus-labs/vanus-connect-runtime/pkg/client/listers/vanus/v1alpha1"
+)
+
+// Store is the backend the runtime lists, gets and watches connectors from. The informer of
+// the connector resource is the default one, other backends allow running connectors without
+// Kubernetes.
+type Store interface {
+	// AddEventHandler registers handler to be notified of the changes of connectors, it's
+	// called before Start.
+	AddEventHandler(handler cache.ResourceEventHandler) error
+	// Start starts syncing the store in the background until Stop is called, ctx only bounds
+	// the startup, an error is returned if the backend is unreachable.
+	Start(ctx context.Context) error
+	// Stop stops syncing the store.
+	Stop()
+	// HasSynced returns true once the store has synced all the connectors.
+	HasSynced() bool
+	// Lister lists connectors from the store.
+	Lister() vanuslister.ConnectorLister
+	// Get gets the latest connector from the backend bypassing the cache of the store.
+	Get(ctx context.Context, name string) (*vanusv1alpha1.Connector, error)
+	// Update updates the connector except its status, it returns a conflict error if the
+	// connector changed since it was read.
+	Update(ctx context.Context, connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error)
+	// UpdateStatus updates the status of the connector, it returns a conflict error if the
+	// connector changed since it was read.
+	UpdateStatus(ctx context.Context, connector *vanusv1alpha1.Connector) (*vanusv1alpha1.Connector, error)
+}
+
+// FilterableStore is implemented by stores which support label selectors, it's required to
+// change the filter by Runtime.SetFilter.
+type FilterableStore interface {
+	Store
+	// WithFilter returns a new store of the same backend selecting connectors by filter.
+	WithFilter(filter string) (Store, error)
+}
+
+// errRuntimeStopped is returned by SetFilter once the runtime is shutting down.
+var errRuntimeStopped = errors.New("runtime is shutting down")
+
+func (r *runtime) addEventHandler(store Store) error {
+	if err := store.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    r.enqueueAddConnector,
+		UpdateFunc: r.enqueueUpdateConnector,
+		DeleteFunc: r.enqueueDeleteConnector,
+	}); err != nil {
+		log.Errorf("failed to add connector event handler: %+v\n", err)
+		return err
+	}
+	return nil
+}
+
+// SetFilter replaces the label selector of the runtime. The connectors are re-listed under the
+// new selector, connectors which no longer match are deleted and the new matching ones are
+// added, exactly like relabeling a connector out of or into the selector.
+func (r *runtime) SetFilter(ctx context.Context, filter string) error {
+	if _, err := labels.Parse(filter); err != nil {
+		return fmt.Errorf("invalid filter %q: %w", filter, err)
+	}
+	filterable, ok := r.currentStore().(FilterableStore)
+	if !ok {
+		return fmt.Errorf("store %T doesn't support filter", r.currentStore())
+	}
+	store, err := filterable.WithFilter(filter)
+	if err != nil {
+		return err
+	}
+	if err = r.addEventHandler(store); err != nil {
+		return err
+	}
+
+	r.filterLock.Lock()
+	defer r.filterLock.Unlock()
+	r.storeLock.Lock()
+	if r.stopped {
+		r.storeLock.Unlock()
+		return errRuntimeStopped
+	}
+	if !r.started {
+		r.store = store
+		r.storeLock.Unlock()
+		return nil
+	}
+	r.storeLock.Unlock()
+
+	if err = store.Start(ctx); err != nil {
+		store.Stop()
+		return err
+	}
+	r.metrics.synced.Set(0)
+	defer func() {
+		r.metrics.synced.Set(1)
+	}()
+	if ok := cache.WaitForCacheSync(ctx.Done(), store.HasSynced); !ok {
+		store.Stop()
+		return fmt.Errorf("failed to wait for caches of filter %q to sync", filter)
+	}
+	r.storeLock.Lock()
+	if r.stopped {
+		// the runtime is shut down while the new store was syncing
+		r.storeLock.Unlock()
+		store.Stop()
+		return errRuntimeStopped
+	}
+	old := r.store
+	r.store = store
+	r.storeLock.Unlock()
+	old.Stop()
+	log.Infof("connector filter changed to %q", filter)
+
+	// sync all the connectors matching the new filter and the ones applied to the handler,
+	// the latter are deleted if they no longer match
+	if err = r.enqueueAllConnectors(); err != nil {
+		return err
+	}
+	r.enqueueAppliedConnectors()
+	return nil
+}
+
+func (r *runtime) currentStore() Store {
+	r.storeLock.RLock()
+	defer r.storeLock.RUnlock()
+	return r.store
+}
+
+// lister returns the lister of the current store, which only lists the connectors selected
+// by the connector filter.
+func (r *runtime) lister() vanuslister.ConnectorLister {
+	return filteredLister{lister: r.currentStore().Lister(), filter: r.filter}
+}
+
+// runtimeLister always lists from the current store of the runtime, so it stays valid after
+// the filter has been changed.
+type runtimeLister struct {
+	r *runtime
+}
+
+func (l runtimeLister) List(selector labels.Selector) ([]*vanusv1alpha1.Connector, error) {
+	return l.r.lister().List(selector)
+}
+
+func (l runtimeLister) Get(name string) (*vanusv1alpha1.Connector, error) {
+	return l.r.lister().Get(name)
+}
@@ -0,0 +1,59 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package runtime_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/client/clientset/versioned/fake"
+	"github.com/vanus-labs/vanus-connect-runtime/pkg/runtime"
+)
+
+func TestSetFilterAfterShutdown(t *testing.T) {
+	store := runtime.NewInformerStore(fake.NewSimpleClientset(), "")
+	r, err := runtime.New(runtime.WithStore(store), runtime.WithHandler(runtime.ConnectorHandlerFuncs{}))
+	if err != nil {
+		t.Fatalf("failed to create runtime: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Run(ctx)
+	}()
+	readyCtx, readyCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer readyCancel()
+	if err = r.WaitForReady(readyCtx); err != nil {
+		t.Fatalf("runtime is not ready: %v", err)
+	}
+	cancel()
+	if err = <-done; err != nil {
+		t.Fatalf("runtime failed: %v", err)
+	}
+
+	if err = r.SetFilter(context.Background(), "team=b"); err == nil {
+		t.Fatal("expected an error setting the filter of a stopped runtime")
+	}
+}
+
+func TestInformerStoreStopTwice(t *testing.T) {
+	store := runtime.NewInformerStore(fake.NewSimpleClientset(), "")
+	if err := store.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start store: %v", err)
+	}
+	store.Stop()
+	store.Stop()
+}